@@ -5,6 +5,7 @@ import (
 	"os"
 
 	gsdk "github.com/bnb-chain/greenfield-go-sdk/client"
+	"github.com/bnb-chain/greenfield-go-sdk/types"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"github.com/mindkit-xyz/mindkit-gitk/internal/commands"
@@ -26,24 +27,28 @@ func main() {
 		}
 	}
 
-	// Initialize BNB Greenfield client
-	greenfieldClient, err := gsdk.New(
-		viper.GetString("greenfield.endpoint"),
-		viper.GetString("greenfield.chainId"),
-		viper.GetString("greenfield.privateKey"),
-	)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error initializing Greenfield client: %v\n", err)
-		os.Exit(1)
+	// Initialize storage backend. Connecting to Greenfield takes a network
+	// round trip, so it waits until a command first uses the remote.
+	backend := storage.NewRetryBackend(storage.NewLazyBackend(func() (storage.Backend, error) {
+		backend, err := newBackend()
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize storage backend: %w", err)
+		}
+		return backend, nil
+	}), retryPolicy())
+
+	// Identity recorded in commits and reflogs
+	identity := storage.Signature{
+		Name:  viper.GetString("user.name"),
+		Email: viper.GetString("user.email"),
 	}
 
-	// Initialize storage
-	objStorage := storage.NewObjectStorage(greenfieldClient, 
-		viper.GetString("storage.bucket"), 
-		viper.GetString("storage.prefix"))
-	refStorage := storage.NewReferenceStorage(greenfieldClient, 
-		viper.GetString("storage.bucket"), 
-		viper.GetString("storage.prefix"))
+	// Initialize remote storage
+	objStorage := storage.NewObjectStorage(backend, viper.GetString("storage.prefix"))
+	if cache := objectCache(); cache != nil {
+		objStorage.SetCache(cache)
+	}
+	refStorage := storage.NewReferenceStorage(backend, viper.GetString("storage.prefix"), identity)
 
 	// Initialize MindKit client
 	mindkitClient := mindkit.NewClient(mindkit.Config{
@@ -62,10 +67,14 @@ and integrates with MindKit's AI capabilities for enhanced project management.`,
 
 	// Add subcommands
 	rootCmd.AddCommand(
-		commands.NewInitCmd(objStorage, refStorage),
-		commands.NewAddCommand(objStorage),
-		commands.NewCommitCommand(objStorage, refStorage, ai),
-		commands.NewPushCommand(objStorage, refStorage),
+		commands.NewInitCmd(),
+		commands.NewAddCommand(),
+		commands.NewCommitCommand(ai, identity),
+		commands.NewPushCommand(objStorage, refStorage, identity),
+		commands.NewPackRefsCommand(refStorage),
+		commands.NewRepackCommand(objStorage),
+		commands.NewReflogCommand(refStorage),
+		commands.NewRevParseCommand(),
 	)
 
 	// Execute root command
@@ -74,3 +83,73 @@ and integrates with MindKit's AI capabilities for enhanced project management.`,
 		os.Exit(1)
 	}
 }
+
+// newBackend creates the storage backend selected by the storage.backend setting
+func newBackend() (storage.Backend, error) {
+	switch kind := viper.GetString("storage.backend"); kind {
+	case "", "greenfield":
+		account, err := types.NewAccountFromPrivateKey("gitk", viper.GetString("greenfield.privateKey"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid Greenfield private key: %w", err)
+		}
+		client, err := gsdk.New(
+			viper.GetString("greenfield.chainId"),
+			viper.GetString("greenfield.endpoint"),
+			gsdk.Option{DefaultAccount: account},
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize Greenfield client: %w", err)
+		}
+		return storage.NewGreenfieldBackend(client, viper.GetString("storage.bucket")), nil
+	case "local":
+		root := viper.GetString("storage.path")
+		if root == "" {
+			return nil, fmt.Errorf("storage.path is required for the local backend")
+		}
+		return storage.NewLocalBackend(root), nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", kind)
+	}
+}
+
+// retryPolicy returns the retry policy for the storage backend, starting
+// from the defaults and applying the storage.retry settings
+func retryPolicy() storage.RetryPolicy {
+	policy := storage.DefaultRetryPolicy
+	if viper.IsSet("storage.retry.maxAttempts") {
+		policy.MaxAttempts = viper.GetInt("storage.retry.maxAttempts")
+	}
+	if viper.IsSet("storage.retry.initialDelay") {
+		policy.InitialDelay = viper.GetDuration("storage.retry.initialDelay")
+	}
+	if viper.IsSet("storage.retry.maxDelay") {
+		policy.MaxDelay = viper.GetDuration("storage.retry.maxDelay")
+	}
+	if viper.IsSet("storage.retry.multiplier") {
+		policy.Multiplier = viper.GetFloat64("storage.retry.multiplier")
+	}
+	return policy
+}
+
+// objectCache returns the local cache of remote objects configured by the
+// storage.cache settings, or nil if it is disabled
+func objectCache() *storage.ObjectCache {
+	size := int64(storage.DefaultCacheSize)
+	if viper.IsSet("storage.cache.maxSize") {
+		size = int64(viper.GetSizeInBytes("storage.cache.maxSize"))
+	}
+	if size == 0 {
+		return nil
+	}
+
+	dir := viper.GetString("storage.cache.path")
+	if dir == "" {
+		var err error
+		if dir, err = storage.DefaultCacheDir(); err != nil {
+			// No cache rather than no gitk
+			return nil
+		}
+	}
+
+	return storage.NewObjectCache(dir, size)
+}
@@ -7,10 +7,11 @@ import (
 	"path/filepath"
 
 	"github.com/spf13/cobra"
+	"github.com/mindkit-xyz/mindkit-gitk/internal/index"
 	"github.com/mindkit-xyz/mindkit-gitk/internal/storage"
 )
 
-func NewAddCommand(store *storage.ObjectStorage) *cobra.Command {
+func NewAddCommand() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "add [<path>...]",
 		Short: "Add file contents to the index",
@@ -21,41 +22,67 @@ preparing the content staged for the next commit.`,
 				return fmt.Errorf("nothing specified, nothing added")
 			}
 
+			// Adding files never moves references, so no identity is needed
+			repo, err := openRepository(storage.Signature{})
+			if err != nil {
+				return err
+			}
+
+			// The index stays locked until it is written back
+			idx, err := index.Lock(repo.indexPath())
+			if err != nil {
+				return err
+			}
+			defer idx.Unlock()
+
+			a := &adder{store: repo.objects, idx: idx, root: repo.root}
 			for _, path := range args {
-				if err := addPath(cmd.Context(), store, path); err != nil {
+				if err := a.addPath(cmd.Context(), path); err != nil {
 					return fmt.Errorf("failed to add %s: %w", path, err)
 				}
 			}
 
-			return nil
+			return idx.Write(repo.indexPath())
 		},
 	}
 
 	return cmd
 }
 
-func addPath(ctx context.Context, store *storage.ObjectStorage, path string) error {
-	info, err := os.Stat(path)
+// adder stages files into the index of the repository at root
+type adder struct {
+	store *storage.ObjectStorage
+	idx   *index.Index
+	root  string
+}
+
+func (a *adder) addPath(ctx context.Context, path string) error {
+	info, err := os.Lstat(path)
 	if err != nil {
 		return err
 	}
 
 	if info.IsDir() {
-		return addDirectory(ctx, store, path)
+		return a.addDirectory(ctx, path)
 	}
 
-	return addFile(ctx, store, path)
+	return a.addFile(ctx, path, info)
 }
 
-func addDirectory(ctx context.Context, store *storage.ObjectStorage, dir string) error {
+func (a *adder) addDirectory(ctx context.Context, dir string) error {
 	entries, err := os.ReadDir(dir)
 	if err != nil {
 		return err
 	}
 
 	for _, entry := range entries {
+		// Never stage repository metadata
+		if entry.IsDir() && (entry.Name() == gitkDir || entry.Name() == ".git") {
+			continue
+		}
+
 		path := filepath.Join(dir, entry.Name())
-		if err := addPath(ctx, store, path); err != nil {
+		if err := a.addPath(ctx, path); err != nil {
 			return err
 		}
 	}
@@ -63,24 +90,95 @@ func addDirectory(ctx context.Context, store *storage.ObjectStorage, dir string)
 	return nil
 }
 
-func addFile(ctx context.Context, store *storage.ObjectStorage, path string) error {
-	data, err := os.ReadFile(path)
+func (a *adder) addFile(ctx context.Context, path string, info os.FileInfo) error {
+	name, err := a.entryName(path)
+	if err != nil {
+		return err
+	}
+
+	// Skip files whose stat data shows they have not changed since they were staged
+	existing, staged := a.idx.Entry(name)
+	if staged && a.idx.UpToDate(existing, info) {
+		return nil
+	}
+
+	hash, err := hashFile(path, info)
 	if err != nil {
 		return err
 	}
+	entry := index.NewEntry(name, info, hash)
+
+	// The content is unchanged, only the stat data needs refreshing
+	if staged && existing.Hash == hash && existing.Mode == entry.Mode {
+		a.idx.Add(entry)
+		return nil
+	}
 
-	// Store the file content in BNB Greenfield
-	hash := calculateHash(data)
-	if err := store.Store(ctx, hash, data); err != nil {
+	// Store the file content in the local object database
+	if err := a.storeFile(ctx, path, info, hash); err != nil {
 		return err
 	}
+	a.idx.Add(entry)
 
-	fmt.Printf("added '%s'\n", path)
+	fmt.Printf("added '%s'\n", name)
 	return nil
 }
 
-func calculateHash(data []byte) string {
-	// Implement SHA-1 hash calculation for Git compatibility
-	// TODO: Implement proper Git hash calculation
-	return fmt.Sprintf("%x", data[:20])
+// entryName returns the index entry name of path: the slash-separated path
+// relative to the repository root
+func (a *adder) entryName(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+
+	rel, err := filepath.Rel(a.root, abs)
+	if err != nil || !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("'%s' is outside repository at '%s'", path, a.root)
+	}
+
+	return filepath.ToSlash(rel), nil
+}
+
+// hashFile returns the blob hash of a file: of its data, or of the link
+// target for a symbolic link. The data is read as a stream, so files of any
+// size can be hashed.
+func hashFile(path string, info os.FileInfo) (string, error) {
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(path)
+		if err != nil {
+			return "", err
+		}
+		return storage.HashObject(storage.BlobObject, []byte(target)), nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	return storage.HashObjectFrom(storage.BlobObject, info.Size(), f)
+}
+
+// storeFile stores the blob hash of a file, streaming its data. The store
+// fails if the file changed since it was hashed.
+func (a *adder) storeFile(ctx context.Context, path string, info os.FileInfo, hash string) error {
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+		_, err = a.store.Store(ctx, hash, storage.BlobObject, []byte(target))
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = a.store.StoreFrom(ctx, hash, storage.BlobObject, info.Size(), f)
+	return err
 }
@@ -0,0 +1,445 @@
+package commands
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/mindkit-xyz/mindkit-gitk/internal/index"
+	"github.com/mindkit-xyz/mindkit-gitk/internal/storage"
+	"github.com/mindkit-xyz/mindkit-gitk/internal/storage/greenfieldtest"
+)
+
+const testPrefix = "repo"
+
+var testIdentity = storage.Signature{Name: "Test", Email: "test@example.com"}
+
+// remote is a Greenfield bucket held by the fake client, with the stores
+// gitk push writes to
+type remote struct {
+	client  *greenfieldtest.Client
+	backend storage.Backend
+	objects *storage.ObjectStorage
+	refs    *storage.ReferenceStorage
+}
+
+func newRemote() *remote {
+	client, backend := greenfieldtest.NewBackend()
+	return &remote{
+		client:  client,
+		backend: backend,
+		objects: storage.NewObjectStorage(backend, testPrefix),
+		refs:    storage.NewReferenceStorage(backend, testPrefix, testIdentity),
+	}
+}
+
+// has reports whether the bucket holds the object named key
+func (r *remote) has(key string) bool {
+	names := r.client.Objects(greenfieldtest.Bucket)
+	i := sort.SearchStrings(names, key)
+	return i < len(names) && names[i] == key
+}
+
+// objectCount returns the number of Git objects stored loose in the bucket
+func (r *remote) objectCount() int {
+	var n int
+	for _, name := range r.client.Objects(greenfieldtest.Bucket) {
+		if strings.HasPrefix(name, testPrefix+"/objects/") {
+			n++
+		}
+	}
+	return n
+}
+
+func objectKey(hash string) string {
+	return testPrefix + "/objects/" + hash[:2] + "/" + hash[2:]
+}
+
+// run executes cmd with args as gitk would
+func run(t *testing.T, cmd *cobra.Command, args ...string) error {
+	t.Helper()
+
+	cmd.SetArgs(args)
+	cmd.SilenceUsage = true
+	cmd.SilenceErrors = true
+	return cmd.ExecuteContext(context.Background())
+}
+
+// newWorkTree initializes a repository in a temporary directory and makes
+// it the working directory for the rest of the test
+func newWorkTree(t *testing.T) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	if err := run(t, NewInitCmd(), "--bucket", greenfieldtest.Bucket, dir); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	return dir
+}
+
+func writeFile(t *testing.T, name, content string) {
+	t.Helper()
+
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// commitAll stages paths, commits them and returns the new HEAD commit
+func commitAll(t *testing.T, message string, paths ...string) string {
+	t.Helper()
+
+	if err := run(t, NewAddCommand(), paths...); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	if err := run(t, NewCommitCommand(nil, testIdentity), "-m", message); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+
+	repo, err := openRepository(testIdentity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := repo.refs.ResolveReference(context.Background(), "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return head.Hash
+}
+
+// reachable returns the objects reachable from the commit hash in the
+// local repository
+func reachable(t *testing.T, hash string) []string {
+	t.Helper()
+
+	repo, err := openRepository(testIdentity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashes, err := missingObjects(context.Background(), repo.objects, hash, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hashes
+}
+
+func TestInitCreatesRepository(t *testing.T) {
+	dir := newWorkTree(t)
+
+	config, err := os.ReadFile(filepath.Join(dir, gitkDir, "config"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(config), `bucket = "`+greenfieldtest.Bucket+`"`) {
+		t.Errorf("config does not name the bucket:\n%s", config)
+	}
+
+	repo, err := openRepository(testIdentity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := repo.refs.ReadReference(context.Background(), "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head.Target != "refs/heads/main" {
+		t.Fatalf("HEAD = %+v, want a symbolic reference to refs/heads/main", head)
+	}
+}
+
+func TestAddStagesFiles(t *testing.T) {
+	ctx := context.Background()
+	newWorkTree(t)
+
+	writeFile(t, "README.md", "# gitk\n")
+	writeFile(t, filepath.Join("src", "main.go"), "package main\n")
+	if err := run(t, NewAddCommand(), "README.md", "src"); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	if err := run(t, NewAddCommand()); err == nil {
+		t.Error("add without paths succeeded")
+	}
+
+	repo, err := openRepository(testIdentity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := index.Read(repo.indexPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{"README.md": "# gitk\n", "src/main.go": "package main\n"} {
+		entry, ok := idx.Entry(name)
+		if !ok {
+			t.Errorf("%s is not staged", name)
+			continue
+		}
+		if _, data, err := repo.objects.Get(ctx, entry.Hash); err != nil || string(data) != content {
+			t.Errorf("blob of %s = %q, %v; want %q", name, data, err, content)
+		}
+	}
+}
+
+func TestPushUploadsObjectsAndMovesBranch(t *testing.T) {
+	ctx := context.Background()
+	remote := newRemote()
+	newWorkTree(t)
+
+	writeFile(t, "README.md", "# gitk\n")
+	writeFile(t, filepath.Join("src", "main.go"), "package main\n")
+	head := commitAll(t, "Initial commit", "README.md", "src")
+
+	push := func() error {
+		return run(t, NewPushCommand(remote.objects, remote.refs, testIdentity))
+	}
+	if err := push(); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+
+	// The commit, its trees and the two blobs are loose objects on the remote
+	objects := reachable(t, head)
+	if len(objects) != 5 {
+		t.Fatalf("got %d reachable objects, want 5", len(objects))
+	}
+	for _, hash := range objects {
+		if !remote.has(objectKey(hash)) {
+			t.Errorf("object %s is not on the remote", hash)
+		}
+	}
+	blob := storage.HashObject(storage.BlobObject, []byte("package main\n"))
+	if _, data, err := remote.objects.Get(ctx, blob); err != nil || string(data) != "package main\n" {
+		t.Errorf("remote blob %s = %q, %v", blob, data, err)
+	}
+
+	if !remote.has(testPrefix + "/refs/heads/main") {
+		t.Fatal("refs/heads/main is not on the remote")
+	}
+	if got, err := remote.refs.GetReference(ctx, "refs/heads/main"); err != nil || got != head {
+		t.Fatalf("remote main = %q, %v; want %s", got, err, head)
+	}
+
+	// The push is recorded in the remote-tracking branch
+	repo, err := openRepository(testIdentity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := repo.refs.GetReference(ctx, "refs/remotes/origin/main"); err != nil || got != head {
+		t.Fatalf("origin/main = %q, %v; want %s", got, err, head)
+	}
+
+	// Pushing again has nothing to do
+	txs := remote.client.Transactions()
+	if err := push(); err != nil {
+		t.Fatalf("second push: %v", err)
+	}
+	if got := remote.client.Transactions(); got != txs {
+		t.Errorf("up-to-date push sent %d transactions", got-txs)
+	}
+
+	// A second commit only uploads what changed
+	writeFile(t, "README.md", "# gitk\n\nGit on BNB Greenfield.\n")
+	second := commitAll(t, "Describe gitk", "README.md")
+	before := remote.objectCount()
+	if err := push(); err != nil {
+		t.Fatalf("third push: %v", err)
+	}
+
+	// The new commit, root tree and README blob; src is unchanged
+	if got := remote.objectCount() - before; got != 3 {
+		t.Errorf("second commit added %d objects to the remote, want 3", got)
+	}
+	for _, hash := range reachable(t, second) {
+		if !remote.has(objectKey(hash)) {
+			t.Errorf("object %s is not on the remote", hash)
+		}
+	}
+	if got, err := remote.refs.GetReference(ctx, "refs/heads/main"); err != nil || got != second {
+		t.Fatalf("remote main = %q, %v; want %s", got, err, second)
+	}
+}
+
+func TestPushPacksManyObjects(t *testing.T) {
+	ctx := context.Background()
+	remote := newRemote()
+	newWorkTree(t)
+
+	writeFile(t, "a.txt", "a\n")
+	writeFile(t, "b.txt", "b\n")
+	head := commitAll(t, "Initial commit", "a.txt", "b.txt")
+
+	if err := run(t, NewPushCommand(remote.objects, remote.refs, testIdentity), "--unpack-limit", "1"); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+
+	// The objects went into a pack and its index rather than loose objects
+	var packs int
+	for _, name := range remote.client.Objects(greenfieldtest.Bucket) {
+		switch filepath.Ext(name) {
+		case ".pack", ".idx":
+			packs++
+		}
+	}
+	if packs != 2 {
+		t.Fatalf("remote holds %d pack files, want a pack and its index: %v", packs, remote.client.Objects(greenfieldtest.Bucket))
+	}
+	for _, hash := range reachable(t, head) {
+		if remote.has(objectKey(hash)) {
+			t.Errorf("object %s was pushed loose", hash)
+		}
+		if _, _, err := remote.objects.Get(ctx, hash); err != nil {
+			t.Errorf("object %s cannot be read from the remote: %v", hash, err)
+		}
+	}
+}
+
+func TestPushRejectsNonFastForward(t *testing.T) {
+	ctx := context.Background()
+	remote := newRemote()
+	newWorkTree(t)
+
+	writeFile(t, "a.txt", "a\n")
+	first := commitAll(t, "Initial commit", "a.txt")
+	if err := run(t, NewPushCommand(remote.objects, remote.refs, testIdentity)); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+
+	// Another clone pushes a commit on top, which has been fetched here but
+	// not merged
+	other := &storage.Commit{
+		Tree:      storage.HashObject(storage.TreeObject, nil),
+		Parents:   []string{first},
+		Author:    testIdentity,
+		Committer: testIdentity,
+		Message:   "Elsewhere\n",
+	}
+	repo, err := openRepository(testIdentity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherHash, err := repo.objects.StoreObject(ctx, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := remote.objects.StoreObject(ctx, other); err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.refs.SetReference(ctx, "refs/heads/main", otherHash, "push"); err != nil {
+		t.Fatal(err)
+	}
+
+	writeFile(t, "a.txt", "a\nb\n")
+	commitAll(t, "Second commit", "a.txt")
+	err = run(t, NewPushCommand(remote.objects, remote.refs, testIdentity))
+	if err == nil || !strings.Contains(err.Error(), "non-fast-forward") {
+		t.Fatalf("push = %v, want a non-fast-forward rejection", err)
+	}
+	if got, err := remote.refs.GetReference(ctx, "refs/heads/main"); err != nil || got != otherHash {
+		t.Fatalf("remote main = %q, %v; want it left at %s", got, err, otherHash)
+	}
+}
+
+func TestPushForceUnlockBreaksStaleLock(t *testing.T) {
+	ctx := context.Background()
+	remote := newRemote()
+	newWorkTree(t)
+
+	writeFile(t, "a.txt", "a\n")
+	head := commitAll(t, "Initial commit", "a.txt")
+
+	// An interrupted push left the lock of the remote branch behind
+	stale := "0000000000000000000000000000000000000000\nlocked-by Other <other@example.com> 1700000000 +0000\n"
+	if err := remote.backend.Create(ctx, testPrefix+"/refs/heads/main.lock", []byte(stale)); err != nil {
+		t.Fatal(err)
+	}
+
+	err := run(t, NewPushCommand(remote.objects, remote.refs, testIdentity))
+	if err == nil || !strings.Contains(err.Error(), "other@example.com") || !strings.Contains(err.Error(), "--force-unlock") {
+		t.Fatalf("push = %v, want a lock error naming its owner", err)
+	}
+
+	if err := run(t, NewPushCommand(remote.objects, remote.refs, testIdentity), "--force-unlock"); err != nil {
+		t.Fatalf("push --force-unlock: %v", err)
+	}
+	if got, err := remote.refs.GetReference(ctx, "refs/heads/main"); err != nil || got != head {
+		t.Fatalf("remote main = %q, %v; want %s", got, err, head)
+	}
+	if remote.has(testPrefix + "/refs/heads/main.lock") {
+		t.Error("the lock of main is still on the remote")
+	}
+}
+
+func TestResolveRevision(t *testing.T) {
+	ctx := context.Background()
+	dir := newWorkTree(t)
+
+	writeFile(t, "a.txt", "a\n")
+	head := commitAll(t, "Initial commit", "a.txt")
+	repo, err := openRepository(testIdentity)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, rev := range []string{head, "HEAD", "@", "main", "refs/heads/main", "HEAD@{0}", "main@{0}"} {
+		if got, err := resolveRevision(ctx, repo.refs, rev); err != nil || got != head {
+			t.Errorf("%s = %q, %v; want %s", rev, got, err, head)
+		}
+	}
+
+	// Only references are looked up, not other files of the repository,
+	// and only object hashes are returned
+	writeFile(t, filepath.Join(dir, gitkDir, "refs", "heads", "broken"), "not a hash\n")
+	for _, rev := range []string{"index", "config", "broken", "HEAD@{1}"} {
+		if got, err := resolveRevision(ctx, repo.refs, rev); err == nil {
+			t.Errorf("%s = %q, want an error", rev, got)
+		}
+	}
+}
+
+func TestPushRequiresBranchOnDetachedHead(t *testing.T) {
+	ctx := context.Background()
+	remote := newRemote()
+	newWorkTree(t)
+
+	writeFile(t, "a.txt", "a\n")
+	head := commitAll(t, "Initial commit", "a.txt")
+	repo, err := openRepository(testIdentity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.refs.SetReference(ctx, "HEAD", head, "checkout"); err != nil {
+		t.Fatal(err)
+	}
+
+	err = run(t, NewPushCommand(remote.objects, remote.refs, testIdentity))
+	if err == nil || !strings.Contains(err.Error(), "not currently on a branch") {
+		t.Fatalf("push = %v, want a detached HEAD error", err)
+	}
+	if remote.has(testPrefix + "/refs/heads/main") {
+		t.Fatal("detached HEAD was pushed to main")
+	}
+
+	// Naming the branch pushes the detached commit to it
+	if err := run(t, NewPushCommand(remote.objects, remote.refs, testIdentity), "origin", "topic"); err != nil {
+		t.Fatalf("push origin topic: %v", err)
+	}
+	if got, err := remote.refs.GetReference(ctx, "refs/heads/topic"); err != nil || got != head {
+		t.Fatalf("remote topic = %q, %v; want %s", got, err, head)
+	}
+}
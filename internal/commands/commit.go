@@ -1,16 +1,19 @@
 package commands
 
 import (
-	"context"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/spf13/cobra"
+	"github.com/mindkit-xyz/mindkit-gitk/internal/index"
 	"github.com/mindkit-xyz/mindkit-gitk/internal/storage"
 	"github.com/mindkit-xyz/mindkit-gitk/internal/mindkit"
 )
 
-func NewCommitCommand(store *storage.ObjectStorage, refStore *storage.ReferenceStorage, ai *mindkit.AI) *cobra.Command {
+// NewCommitCommand creates the commit command. identity supplies the name and
+// email recorded as author and committer.
+func NewCommitCommand(ai *mindkit.AI, identity storage.Signature) *cobra.Command {
 	var message string
 	var useAI bool
 
@@ -31,24 +34,62 @@ the given log message describing the changes.`,
 				return fmt.Errorf("please provide a commit message")
 			}
 
+			repo, err := openRepository(identity)
+			if err != nil {
+				return err
+			}
+
+			idx, err := index.Read(repo.indexPath())
+			if err != nil {
+				return err
+			}
+			if len(idx.Entries) == 0 {
+				return fmt.Errorf("nothing to commit (use \"gitk add\" to stage files)")
+			}
+
+			if identity.Name == "" || identity.Email == "" {
+				return fmt.Errorf("author identity unknown: set user.name and user.email in the gitk config")
+			}
+
+			// Store the trees of the staged files
+			treeHash, err := idx.WriteTree(cmd.Context(), repo.objects)
+			if err != nil {
+				return fmt.Errorf("failed to store tree: %w", err)
+			}
+
+			// HEAD resolves to the current branch, or to itself when detached
+			head, err := repo.refs.ResolveReference(cmd.Context(), "HEAD")
+			if err != nil {
+				return err
+			}
+
 			// Create commit object
-			commit := &Commit{
-				Message:   message,
-				Author:    "user@example.com", // TODO: Get from config
-				Date:     time.Now(),
-				Parent:   "", // TODO: Get current HEAD
+			author := identity
+			author.When = time.Now()
+			commit := &storage.Commit{
+				Tree:      treeHash,
+				Author:    author,
+				Committer: author,
+				Message:   message + "\n",
+			}
+			if !head.Unborn() {
+				commit.Parents = []string{head.Hash}
 			}
 
 			// Store commit object
-			commitData := commit.Serialize()
-			hash := calculateHash(commitData)
-			if err := store.Store(cmd.Context(), hash, commitData); err != nil {
+			hash, err := repo.objects.StoreObject(cmd.Context(), commit)
+			if err != nil {
 				return fmt.Errorf("failed to store commit: %w", err)
 			}
 
-			// Update HEAD reference
-			if err := refStore.SetReference(cmd.Context(), "HEAD", hash); err != nil {
-				return fmt.Errorf("failed to update HEAD: %w", err)
+			// Advance the current branch
+			reason := "commit"
+			if head.Unborn() {
+				reason = "commit (initial)"
+			}
+			subject, _, _ := strings.Cut(message, "\n")
+			if err := repo.refs.CompareAndSetReference(cmd.Context(), head.Name, hash, head.Hash, reason+": "+subject); err != nil {
+				return fmt.Errorf("failed to update %s: %w", head.Name, err)
 			}
 
 			fmt.Printf("[%s] %s\n", hash[:7], message)
@@ -61,20 +102,3 @@ the given log message describing the changes.`,
 
 	return cmd
 }
-
-type Commit struct {
-	Message string
-	Author  string
-	Date    time.Time
-	Parent  string
-}
-
-func (c *Commit) Serialize() []byte {
-	// TODO: Implement proper Git commit object serialization
-	return []byte(fmt.Sprintf("commit %s\n%s\n%s\n%s",
-		c.Parent,
-		c.Author,
-		c.Date.Format(time.RFC3339),
-		c.Message,
-	))
-}
@@ -1,7 +1,6 @@
 package commands
 
 import (
-	"context"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -10,7 +9,7 @@ import (
 	"github.com/mindkit-xyz/mindkit-gitk/internal/storage"
 )
 
-func NewInitCmd(store *storage.ObjectStorage, refStore *storage.ReferenceStorage) *cobra.Command {
+func NewInitCmd() *cobra.Command {
 	var bucketName string
 
 	cmd := &cobra.Command{
@@ -24,10 +23,12 @@ This command creates a new .gitk directory with the repository configuration.`,
 				path = args[0]
 			}
 
-			// Create .gitk directory
-			gitkDir := filepath.Join(path, ".gitk")
-			if err := os.MkdirAll(gitkDir, 0755); err != nil {
-				return fmt.Errorf("failed to create .gitk directory: %w", err)
+			// Create .gitk directory with the local object and reference stores
+			dir := filepath.Join(path, gitkDir)
+			for _, sub := range []string{"objects", filepath.Join("refs", "heads")} {
+				if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+					return fmt.Errorf("failed to create .gitk directory: %w", err)
+				}
 			}
 
 			// Create config file
@@ -35,16 +36,17 @@ This command creates a new .gitk directory with the repository configuration.`,
 bucket = "%s"
 `, bucketName)
 
-			if err := os.WriteFile(filepath.Join(gitkDir, "config"), []byte(config), 0644); err != nil {
+			if err := os.WriteFile(filepath.Join(dir, "config"), []byte(config), 0644); err != nil {
 				return fmt.Errorf("failed to write config file: %w", err)
 			}
 
-			// Initialize empty HEAD reference
-			if err := refStore.SetReference(context.Background(), "HEAD", "refs/heads/main"); err != nil {
+			// Point HEAD at the yet unborn main branch
+			repo := newRepository(path, storage.Signature{})
+			if err := repo.refs.SetSymbolicReference(cmd.Context(), "HEAD", "refs/heads/main"); err != nil {
 				return fmt.Errorf("failed to initialize HEAD reference: %w", err)
 			}
 
-			fmt.Printf("Initialized empty Gitk repository in %s\n", gitkDir)
+			fmt.Printf("Initialized empty Gitk repository in %s\n", dir)
 			return nil
 		},
 	}
@@ -0,0 +1,31 @@
+package commands
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/mindkit-xyz/mindkit-gitk/internal/storage"
+)
+
+func NewPackRefsCommand(refStore *storage.ReferenceStorage) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "pack-refs",
+		Short: "Pack remote refs for efficient listing",
+		Long: `Moves the branches and tags stored on the remote into a single packed-refs
+object, so they can be listed with one request instead of one per ref.
+Refs updated later are stored loose again and take precedence over their
+packed values until the next run.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			count, err := refStore.PackRefs(cmd.Context())
+			if err != nil {
+				return fmt.Errorf("failed to pack refs: %w", err)
+			}
+
+			fmt.Printf("Packed %d refs\n", count)
+			return nil
+		},
+	}
+
+	return cmd
+}
@@ -1,44 +1,111 @@
 package commands
 
 import (
+	"container/heap"
 	"context"
+	"errors"
 	"fmt"
+	"os"
+	"strings"
 
 	"github.com/spf13/cobra"
 	"github.com/mindkit-xyz/mindkit-gitk/internal/storage"
 )
 
-func NewPushCommand(store *storage.ObjectStorage, refStore *storage.ReferenceStorage) *cobra.Command {
+// NewPushCommand creates the push command. identity is recorded in the
+// reflog of the updated local remote-tracking reference.
+func NewPushCommand(store *storage.ObjectStorage, refStore *storage.ReferenceStorage, identity storage.Signature) *cobra.Command {
+	var concurrency, batchSize, unpackLimit int
+	var forceUnlock bool
+	packOpts := storage.DefaultPackOptions
+
 	cmd := &cobra.Command{
 		Use:   "push [<remote>] [<branch>]",
 		Short: "Update remote refs along with associated objects",
 		Long: `Updates remote refs using local refs, while sending objects
 necessary to complete the given refs.`,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			// Get current HEAD reference
-			headHash, err := refStore.GetReference(cmd.Context(), "HEAD")
+			repo, err := openRepository(identity)
 			if err != nil {
-				return fmt.Errorf("failed to get HEAD: %w", err)
+				return err
 			}
 
-			// Push objects to BNB Greenfield
-			if err := pushObjects(cmd.Context(), store, headHash); err != nil {
-				return fmt.Errorf("failed to push objects: %w", err)
+			// Get the commit HEAD points to
+			head, err := repo.refs.ResolveReference(cmd.Context(), "HEAD")
+			if err != nil {
+				return err
 			}
+			if head.Unborn() {
+				return fmt.Errorf("nothing to push: %s has no commits yet", head.Name)
+			}
+			headHash := head.Hash
 
-			// Update remote reference
+			// Push the current branch unless another one is given
 			remote := "origin"
-			branch := "main"
+			branch := strings.TrimPrefix(head.Name, "refs/heads/")
 			if len(args) > 0 {
 				remote = args[0]
 			}
 			if len(args) > 1 {
 				branch = args[1]
+			} else if head.Name == "HEAD" {
+				return fmt.Errorf("you are not currently on a branch; to push the history leading to "+
+					"the current (detached HEAD) state, use gitk push %s <branch>", remote)
+			}
+
+			branchRef := fmt.Sprintf("refs/heads/%s", branch)
+			if forceUnlock {
+				broken, err := refStore.BreakLock(cmd.Context(), branchRef)
+				if err != nil {
+					return fmt.Errorf("failed to unlock remote ref: %w", remoteError(err))
+				}
+				if broken {
+					fmt.Fprintf(os.Stderr, "Removed the lock of %s/%s\n", remote, branch)
+				}
+			}
+
+			// A branch missing on the remote resolves as unborn
+			remoteTip, err := refStore.ResolveReference(cmd.Context(), branchRef)
+			if err != nil {
+				return fmt.Errorf("failed to get remote ref: %w", remoteError(err))
+			}
+			if remoteTip.Hash == headHash {
+				fmt.Println("Everything up-to-date")
+				return nil
+			}
+
+			// Refuse to discard commits on the remote that are missing locally
+			if !remoteTip.Unborn() {
+				fastForward, err := isAncestor(cmd.Context(), repo.objects, remoteTip.Hash, headHash)
+				if err != nil {
+					return err
+				}
+				if !fastForward {
+					return fmt.Errorf("rejected: %s/%s contains commits that are not in the local branch (non-fast-forward)", remote, branch)
+				}
 			}
 
+			// Push objects to BNB Greenfield
+			if err := pushObjects(cmd.Context(), repo.objects, store, headHash, remoteTip.Hash, unpackLimit, packOpts, storage.BatchOptions{
+				Concurrency: concurrency,
+				BatchSize:   batchSize,
+			}); err != nil {
+				return fmt.Errorf("failed to push objects: %w", remoteError(err))
+			}
+
+			// Update remote reference, unless someone else pushed meanwhile
+			if err := refStore.CompareAndSetReference(cmd.Context(), branchRef, headHash, remoteTip.Hash, "push"); err != nil {
+				var conflict *storage.RefConflictError
+				if errors.As(err, &conflict) {
+					return fmt.Errorf("rejected: %s/%s was updated by another push, try again: %w", remote, branch, err)
+				}
+				return fmt.Errorf("failed to update remote ref: %w", remoteError(err))
+			}
+
+			// Record the new remote state in the remote-tracking reference
 			remoteRef := fmt.Sprintf("refs/remotes/%s/%s", remote, branch)
-			if err := refStore.SetReference(cmd.Context(), remoteRef, headHash); err != nil {
-				return fmt.Errorf("failed to update remote ref: %w", err)
+			if err := repo.refs.SetReference(cmd.Context(), remoteRef, headHash, "update by push"); err != nil {
+				return fmt.Errorf("failed to update remote-tracking ref: %w", err)
 			}
 
 			fmt.Printf("Successfully pushed to %s/%s\n", remote, branch)
@@ -46,12 +113,313 @@ necessary to complete the given refs.`,
 		},
 	}
 
+	cmd.Flags().IntVarP(&concurrency, "jobs", "j", storage.DefaultConcurrency, "number of batches of objects uploaded in parallel")
+	cmd.Flags().IntVar(&batchSize, "batch-size", storage.DefaultBatchSize, "number of objects created per transaction")
+	cmd.Flags().IntVar(&unpackLimit, "unpack-limit", storage.DefaultUnpackLimit, "number of objects from which they are pushed as a packfile rather than loose")
+	cmd.Flags().IntVar(&packOpts.Window, "window", packOpts.Window, "number of objects considered as delta base for each packed object, 0 to disable deltas")
+	cmd.Flags().IntVar(&packOpts.Depth, "depth", packOpts.Depth, "maximum delta chain length in packs")
+	cmd.Flags().BoolVar(&forceUnlock, "force-unlock", false, "remove the lock of the remote branch left behind by an interrupted push")
+
 	return cmd
 }
 
-func pushObjects(ctx context.Context, store *storage.ObjectStorage, hash string) error {
-	// TODO: Implement pushing all objects reachable from the given hash
-	// This would involve traversing the commit graph and ensuring all
-	// objects are stored in BNB Greenfield
+// remoteError adds advice to failures of the remote storage that the user
+// can act on
+func remoteError(err error) error {
+	switch {
+	case errors.Is(err, storage.ErrPermissionDenied):
+		return fmt.Errorf("%w (check that the configured account may write to the bucket)", err)
+	case errors.Is(err, storage.ErrQuotaExceeded):
+		return fmt.Errorf("%w (the bucket's quota or the account's balance is exhausted)", err)
+	case errors.Is(err, storage.ErrTransient):
+		return fmt.Errorf("%w (the remote storage is temporarily unavailable, try again later)", err)
+	}
+	return err
+}
+
+// pushObjects uploads the objects reachable from hash that are not already
+// reachable from remoteHash, the commit the remote branch points at. At
+// least unpackLimit objects are uploaded as one packfile compressed as
+// configured by packOpts, fewer as loose objects in batches as configured by
+// opts. The history of remoteHash must be available locally.
+func pushObjects(ctx context.Context, local, remote *storage.ObjectStorage, hash, remoteHash string, unpackLimit int, packOpts storage.PackOptions, opts storage.BatchOptions) error {
+	missing, err := missingObjects(ctx, local, hash, remoteHash)
+	if err != nil {
+		return err
+	}
+
+	var result storage.BatchResult
+	if len(missing) >= unpackLimit {
+		fmt.Fprintf(os.Stderr, "Packing %d objects\n", len(missing))
+		result, err = remote.StorePack(ctx, missing, local.Open, packOpts)
+	} else {
+		result, err = storeLoose(ctx, local, remote, missing, opts)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Objects can be on the remote without being reachable from its branch,
+	// for example after an interrupted push
+	fmt.Printf("Pushed %d objects", result.Uploaded)
+	if result.Skipped > 0 {
+		fmt.Printf(", skipped %d already on the remote", result.Skipped)
+	}
+	fmt.Println()
+	return nil
+}
+
+// storeLoose uploads the objects missing on the remote as loose objects,
+// reporting progress on stderr
+func storeLoose(ctx context.Context, local, remote *storage.ObjectStorage, missing []string, opts storage.BatchOptions) (storage.BatchResult, error) {
+	// The objects are uploaded in no particular order. That is safe because
+	// the remote branch is only moved once all of them are stored.
+	var done int
+	opts.Progress = func(hash string, uploaded bool) {
+		done++
+		fmt.Fprintf(os.Stderr, "\rWriting objects: %3d%% (%d/%d)", done*100/len(missing), done, len(missing))
+	}
+	result, err := remote.StoreBatch(ctx, missing, local.Open, opts)
+	if done > 0 {
+		fmt.Fprintln(os.Stderr)
+	}
+	return result, err
+}
+
+// isAncestor reports whether the commit ancestor is reachable from the commit hash
+func isAncestor(ctx context.Context, store *storage.ObjectStorage, ancestor, hash string) (bool, error) {
+	seen := make(map[string]bool)
+	pending := []string{hash}
+	for len(pending) > 0 {
+		hash := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if hash == ancestor {
+			return true, nil
+		}
+		if seen[hash] {
+			continue
+		}
+		seen[hash] = true
+
+		obj, err := store.GetObject(ctx, hash)
+		if err != nil {
+			return false, err
+		}
+		commit, ok := obj.(*storage.Commit)
+		if !ok {
+			return false, fmt.Errorf("object %s is a %s, not a commit", hash, obj.Type())
+		}
+		pending = append(pending, commit.Parents...)
+	}
+
+	return false, nil
+}
+
+// missingObjects returns the objects reachable from hash that are not
+// reachable from remoteHash. Only the history above the merge base is
+// walked, and of the commits the remote has, only the trees of those next
+// to new commits are loaded, to skip the objects new commits share with them.
+func missingObjects(ctx context.Context, store *storage.ObjectStorage, hash, remoteHash string) ([]string, error) {
+	commits, boundary, err := newCommits(ctx, store, hash, remoteHash)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &objectWalker{store: store, seen: make(map[string]bool)}
+	for _, commit := range boundary {
+		if err := w.walkTree(ctx, commit.Tree, nil); err != nil {
+			return nil, fmt.Errorf("failed to walk remote history: %w", err)
+		}
+	}
+
+	var missing []string
+	visit := func(hash string) {
+		missing = append(missing, hash)
+	}
+	for _, c := range commits {
+		w.seen[c.hash] = true
+		visit(c.hash)
+		if err := w.walkTree(ctx, c.commit.Tree, visit); err != nil {
+			return nil, err
+		}
+	}
+
+	return missing, nil
+}
+
+// Flags of the commits newCommits reaches
+const (
+	reachableFromLocal = 1 << iota
+	reachableFromRemote
+)
+
+// newCommits returns the commits reachable from hash but not from
+// remoteHash, and the commits reachable from remoteHash that are parents of
+// those. Both histories are walked together, newest commit first, until
+// only commits reachable from remoteHash are left to walk, so the history
+// below the merge base is not loaded. Commit dates out of order only make
+// the walk go further.
+func newCommits(ctx context.Context, store *storage.ObjectStorage, hash, remoteHash string) ([]queuedCommit, []*storage.Commit, error) {
+	var (
+		queue   commitQueue
+		flags   = make(map[string]int)
+		walked  = make(map[string]int)
+		commits = make(map[string]*storage.Commit)
+		order   []string
+	)
+	enqueue := func(hash string, flag int) error {
+		if flags[hash]|flag == flags[hash] {
+			return nil
+		}
+		flags[hash] |= flag
+
+		commit, ok := commits[hash]
+		if !ok {
+			var err error
+			if commit, err = loadCommit(ctx, store, hash); err != nil {
+				return err
+			}
+			commits[hash] = commit
+		}
+		heap.Push(&queue, queuedCommit{hash: hash, commit: commit})
+		return nil
+	}
+
+	if err := enqueue(hash, reachableFromLocal); err != nil {
+		return nil, nil, err
+	}
+	if remoteHash != "" {
+		if err := enqueue(remoteHash, reachableFromRemote); err != nil {
+			return nil, nil, fmt.Errorf("failed to walk remote history: %w", err)
+		}
+	}
+
+	for !queue.onlyReachableFrom(flags, reachableFromRemote) {
+		c := heap.Pop(&queue).(queuedCommit)
+		flag := flags[c.hash]
+		if walked[c.hash] == flag {
+			// Queued again for a flag it has passed on already
+			continue
+		}
+		if walked[c.hash] == 0 {
+			order = append(order, c.hash)
+		}
+		walked[c.hash] = flag
+
+		for _, parent := range c.commit.Parents {
+			if err := enqueue(parent, flag); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	var (
+		fresh      []queuedCommit
+		boundary   []*storage.Commit
+		inBoundary = make(map[string]bool)
+	)
+	for _, hash := range order {
+		if flags[hash] != reachableFromLocal {
+			continue
+		}
+		fresh = append(fresh, queuedCommit{hash: hash, commit: commits[hash]})
+		for _, parent := range commits[hash].Parents {
+			if flags[parent]&reachableFromRemote != 0 && !inBoundary[parent] {
+				inBoundary[parent] = true
+				boundary = append(boundary, commits[parent])
+			}
+		}
+	}
+
+	return fresh, boundary, nil
+}
+
+// loadCommit reads the commit hash from store
+func loadCommit(ctx context.Context, store *storage.ObjectStorage, hash string) (*storage.Commit, error) {
+	obj, err := store.GetObject(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+	commit, ok := obj.(*storage.Commit)
+	if !ok {
+		return nil, fmt.Errorf("object %s is a %s, not a commit", hash, obj.Type())
+	}
+	return commit, nil
+}
+
+// queuedCommit is a commit waiting in a commitQueue
+type queuedCommit struct {
+	hash   string
+	commit *storage.Commit
+}
+
+// commitQueue is a heap of commits, the most recently committed first
+type commitQueue []queuedCommit
+
+func (q commitQueue) Len() int { return len(q) }
+func (q commitQueue) Less(i, j int) bool {
+	return q[i].commit.Committer.When.After(q[j].commit.Committer.When)
+}
+func (q commitQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q *commitQueue) Push(x any)   { *q = append(*q, x.(queuedCommit)) }
+func (q *commitQueue) Pop() any {
+	old := *q
+	c := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return c
+}
+
+// onlyReachableFrom reports whether every queued commit has flag
+func (q commitQueue) onlyReachableFrom(flags map[string]int, flag int) bool {
+	for _, c := range q {
+		if flags[c.hash]&flag == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// objectWalker traverses the trees of a repository, visiting every object
+// at most once
+type objectWalker struct {
+	store *storage.ObjectStorage
+	seen  map[string]bool
+}
+
+// walkTree visits the tree hash and everything below it
+func (w *objectWalker) walkTree(ctx context.Context, hash string, visit func(hash string)) error {
+	if w.seen[hash] {
+		return nil
+	}
+	w.seen[hash] = true
+	if visit != nil {
+		visit(hash)
+	}
+
+	obj, err := w.store.GetObject(ctx, hash)
+	if err != nil {
+		return err
+	}
+	tree, ok := obj.(*storage.Tree)
+	if !ok {
+		return fmt.Errorf("object %s is a %s, not a tree", hash, obj.Type())
+	}
+
+	for _, entry := range tree.Entries {
+		switch {
+		case entry.Mode.IsTree():
+			if err := w.walkTree(ctx, entry.Hash, visit); err != nil {
+				return err
+			}
+		case entry.Mode == storage.ModeSubmodule:
+			// Submodule commits live in another repository
+		case !w.seen[entry.Hash]:
+			w.seen[entry.Hash] = true
+			if visit != nil {
+				visit(entry.Hash)
+			}
+		}
+	}
+
 	return nil
 }
@@ -0,0 +1,118 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/mindkit-xyz/mindkit-gitk/internal/storage"
+)
+
+// countingBackend counts the reads of each key
+type countingBackend struct {
+	storage.Backend
+	reads map[string]int
+}
+
+func (b *countingBackend) Get(ctx context.Context, key string) ([]byte, error) {
+	b.reads[key]++
+	return b.Backend.Get(ctx, key)
+}
+
+func (b *countingBackend) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	b.reads[key]++
+	return b.Backend.Open(ctx, key)
+}
+
+func TestMissingObjectsStopsAtMergeBase(t *testing.T) {
+	ctx := context.Background()
+	backend := &countingBackend{Backend: storage.NewLocalBackend(t.TempDir()), reads: make(map[string]int)}
+	store := storage.NewObjectStorage(backend, "")
+	mustStore := func(obj storage.GitObject) string {
+		hash, err := store.StoreObject(ctx, obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hash
+	}
+
+	// A linear history of four commits, each changing one file next to a
+	// file they all share
+	common := mustStore(&storage.Blob{Data: []byte("common\n")})
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var commits, trees, blobs []string
+	for i := 0; i < 4; i++ {
+		blob := mustStore(&storage.Blob{Data: []byte(fmt.Sprintf("version %d\n", i))})
+		tree := mustStore(&storage.Tree{Entries: []storage.TreeEntry{
+			{Mode: storage.ModeBlob, Name: "common.txt", Hash: common},
+			{Mode: storage.ModeBlob, Name: "file.txt", Hash: blob},
+		}})
+		signature := testIdentity
+		signature.When = start.Add(time.Duration(i) * time.Hour)
+		commit := &storage.Commit{Tree: tree, Author: signature, Committer: signature, Message: fmt.Sprintf("commit %d\n", i)}
+		if i > 0 {
+			commit.Parents = []string{commits[i-1]}
+		}
+		commits = append(commits, mustStore(commit))
+		trees = append(trees, tree)
+		blobs = append(blobs, blob)
+	}
+	for key := range backend.reads {
+		delete(backend.reads, key)
+	}
+
+	missing, err := missingObjects(ctx, store, commits[3], commits[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{commits[3], trees[3], blobs[3]}
+	sort.Strings(missing)
+	sort.Strings(want)
+	if fmt.Sprint(missing) != fmt.Sprint(want) {
+		t.Errorf("missing = %v, want %v", missing, want)
+	}
+
+	// Nothing below the remote branch was loaded
+	for _, hash := range []string{commits[0], commits[1], trees[0], trees[1]} {
+		if n := backend.reads["objects/"+hash[:2]+"/"+hash[2:]]; n != 0 {
+			t.Errorf("object %s below the merge base was read %d times", hash, n)
+		}
+	}
+}
+
+func TestMissingObjectsOfNewBranch(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewObjectStorage(storage.NewLocalBackend(t.TempDir()), "")
+
+	blob, err := store.StoreObject(ctx, &storage.Blob{Data: []byte("a\n")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := store.StoreObject(ctx, &storage.Tree{Entries: []storage.TreeEntry{{Mode: storage.ModeBlob, Name: "a.txt", Hash: blob}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := store.StoreObject(ctx, &storage.Commit{Tree: tree, Author: testIdentity, Committer: testIdentity, Message: "first\n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := store.StoreObject(ctx, &storage.Commit{Tree: tree, Parents: []string{first}, Author: testIdentity, Committer: testIdentity, Message: "second\n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Everything is missing on a remote without the branch
+	missing, err := missingObjects(ctx, store, second, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{second, tree, blob, first}
+	sort.Strings(missing)
+	sort.Strings(want)
+	if fmt.Sprint(missing) != fmt.Sprint(want) {
+		t.Errorf("missing = %v, want %v", missing, want)
+	}
+}
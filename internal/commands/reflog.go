@@ -0,0 +1,56 @@
+package commands
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/mindkit-xyz/mindkit-gitk/internal/storage"
+)
+
+func NewReflogCommand(refStore *storage.ReferenceStorage) *cobra.Command {
+	var remote bool
+
+	cmd := &cobra.Command{
+		Use:   "reflog [<ref>]",
+		Short: "Show the history of a ref",
+		Long: `Shows the reflog of a ref, HEAD by default: every value the ref had, newest
+first, along with the operation that set it. The values can be used as
+revisions in the form <ref>@{<n>}.`,
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			refs := refStore
+			if !remote {
+				repo, err := openRepository(storage.Signature{})
+				if err != nil {
+					return err
+				}
+				refs = repo.refs
+			}
+
+			name := "HEAD"
+			if len(args) > 0 {
+				name = args[0]
+			}
+			refName, err := expandRefName(cmd.Context(), refs, name)
+			if err != nil {
+				return err
+			}
+
+			entries, err := refs.ReadReflog(cmd.Context(), refName)
+			if err != nil {
+				return err
+			}
+
+			for n := 0; n < len(entries); n++ {
+				entry := entries[len(entries)-1-n]
+				fmt.Printf("%s %s@{%d}: %s\n", abbrev(entry.New), name, n, entry.Message)
+			}
+
+			return nil
+		},
+	}
+
+	cmd.Flags().BoolVar(&remote, "remote", false, "show the reflog of a ref on the remote storage")
+
+	return cmd
+}
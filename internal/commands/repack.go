@@ -0,0 +1,36 @@
+package commands
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/mindkit-xyz/mindkit-gitk/internal/storage"
+)
+
+func NewRepackCommand(store *storage.ObjectStorage) *cobra.Command {
+	opts := storage.DefaultPackOptions
+
+	cmd := &cobra.Command{
+		Use:   "repack",
+		Short: "Pack remote objects with delta compression",
+		Long: `Combines the loose objects and packs stored on the remote into a single
+pack, storing similar objects as deltas of each other, then removes the
+loose objects and packs it replaces. Successive versions of a file that
+change little take up little more space than one.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			count, err := store.Repack(cmd.Context(), opts)
+			if err != nil {
+				return fmt.Errorf("failed to repack: %w", remoteError(err))
+			}
+
+			fmt.Printf("Packed %d objects\n", count)
+			return nil
+		},
+	}
+
+	cmd.Flags().IntVar(&opts.Window, "window", opts.Window, "number of objects considered as delta base for each object, 0 to disable deltas")
+	cmd.Flags().IntVar(&opts.Depth, "depth", opts.Depth, "maximum delta chain length")
+
+	return cmd
+}
@@ -0,0 +1,68 @@
+package commands
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/mindkit-xyz/mindkit-gitk/internal/storage"
+)
+
+// gitkDir is the name of the directory holding a repository's metadata
+const gitkDir = ".gitk"
+
+// repository is a local Gitk repository. Its objects and references are
+// kept below the .gitk directory in the same layout git uses, and are only
+// uploaded to the remote storage by push.
+type repository struct {
+	root    string
+	objects *storage.ObjectStorage
+	refs    *storage.ReferenceStorage
+}
+
+// newRepository returns the repository whose working tree is at root.
+// Reference updates are logged under identity.
+func newRepository(root string, identity storage.Signature) *repository {
+	backend := storage.NewLocalBackend(filepath.Join(root, gitkDir))
+	return &repository{
+		root:    root,
+		objects: storage.NewObjectStorage(backend, ""),
+		refs:    storage.NewReferenceStorage(backend, "", identity),
+	}
+}
+
+// openRepository opens the repository containing the working directory
+func openRepository(identity storage.Signature) (*repository, error) {
+	root, err := findRepositoryRoot()
+	if err != nil {
+		return nil, err
+	}
+	return newRepository(root, identity), nil
+}
+
+// indexPath returns the path of the repository's index file
+func (r *repository) indexPath() string {
+	return filepath.Join(r.root, gitkDir, "index")
+}
+
+// findRepositoryRoot returns the closest directory at or above the working
+// directory that contains a .gitk directory
+func findRepositoryRoot() (string, error) {
+	dir, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+
+	for {
+		info, err := os.Stat(filepath.Join(dir, gitkDir))
+		if err == nil && info.IsDir() {
+			return dir, nil
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", fmt.Errorf("not a gitk repository (or any of the parent directories): %s", gitkDir)
+		}
+		dir = parent
+	}
+}
@@ -0,0 +1,37 @@
+package commands
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/mindkit-xyz/mindkit-gitk/internal/storage"
+)
+
+func NewRevParseCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "rev-parse <revision>...",
+		Short: "Resolve revisions to object names",
+		Long: `Prints the object name of each revision. A revision is an object name, a
+ref such as "main" or "refs/tags/v1", or "<ref>@{<n>}" for the value the ref
+had n updates ago, as recorded in its reflog.`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			repo, err := openRepository(storage.Signature{})
+			if err != nil {
+				return err
+			}
+
+			for _, rev := range args {
+				hash, err := resolveRevision(cmd.Context(), repo.refs, rev)
+				if err != nil {
+					return err
+				}
+				fmt.Println(hash)
+			}
+
+			return nil
+		},
+	}
+
+	return cmd
+}
@@ -0,0 +1,164 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/mindkit-xyz/mindkit-gitk/internal/storage"
+)
+
+// refSearchPatterns are the places a short reference name is looked up, in
+// the order git uses. The name itself is only tried for full names below
+// refs/ and for root references such as HEAD, see isRootRefName.
+var refSearchPatterns = []string{
+	"%s",
+	"refs/%s",
+	"refs/tags/%s",
+	"refs/heads/%s",
+	"refs/remotes/%s",
+	"refs/remotes/%s/HEAD",
+}
+
+// resolveRevision returns the object hash a revision names. Supported are
+// full object hashes, reference names as in "main" or "refs/tags/v1", "@"
+// for HEAD, and "<ref>@{<n>}" for the n-th prior value of a reference
+// according to its reflog, where a bare "@{<n>}" refers to the current branch.
+func resolveRevision(ctx context.Context, refs *storage.ReferenceStorage, rev string) (string, error) {
+	hash, err := resolveRevisionValue(ctx, refs, rev)
+	if err != nil {
+		return "", err
+	}
+
+	// References and reflogs are only text on the storage
+	if !isHash(hash) {
+		return "", fmt.Errorf("revision '%s' does not name an object: found '%s'", rev, hash)
+	}
+	return hash, nil
+}
+
+// resolveRevisionValue returns the value rev resolves to, before it is
+// checked to be an object hash
+func resolveRevisionValue(ctx context.Context, refs *storage.ReferenceStorage, rev string) (string, error) {
+	name, n, hasReflogSuffix, err := parseReflogSuffix(rev)
+	if err != nil {
+		return "", err
+	}
+
+	if !hasReflogSuffix {
+		if isHash(rev) {
+			return rev, nil
+		}
+		if rev == "@" {
+			rev = "HEAD"
+		}
+		refName, err := expandRefName(ctx, refs, rev)
+		if err != nil {
+			return "", err
+		}
+		return refs.GetReference(ctx, refName)
+	}
+
+	var refName string
+	if name == "" {
+		// The current branch, not HEAD itself
+		head, err := refs.ResolveReference(ctx, "HEAD")
+		if err != nil {
+			return "", err
+		}
+		refName = head.Name
+	} else if refName, err = expandRefName(ctx, refs, name); err != nil {
+		return "", err
+	}
+
+	entries, err := refs.ReadReflog(ctx, refName)
+	if err != nil {
+		return "", err
+	}
+	if n >= len(entries) {
+		return "", fmt.Errorf("log for '%s' only has %d entries", refName, len(entries))
+	}
+
+	return entries[len(entries)-1-n].New, nil
+}
+
+// parseReflogSuffix splits "<name>@{<n>}" into name and n. ok is false if rev
+// has no such suffix.
+func parseReflogSuffix(rev string) (name string, n int, ok bool, err error) {
+	if !strings.HasSuffix(rev, "}") {
+		return rev, 0, false, nil
+	}
+	at := strings.LastIndex(rev, "@{")
+	if at < 0 {
+		return rev, 0, false, nil
+	}
+
+	n, err = strconv.Atoi(rev[at+2 : len(rev)-1])
+	if err != nil || n < 0 {
+		return "", 0, false, fmt.Errorf("invalid reflog position in '%s'", rev)
+	}
+
+	return rev[:at], n, true, nil
+}
+
+// expandRefName returns the full name of the existing reference that the
+// possibly abbreviated name refers to
+func expandRefName(ctx context.Context, refs *storage.ReferenceStorage, name string) (string, error) {
+	for _, pattern := range refSearchPatterns {
+		if pattern == "%s" && !strings.HasPrefix(name, "refs/") && !isRootRefName(name) {
+			continue
+		}
+		refName := fmt.Sprintf(pattern, name)
+		_, err := refs.ReadReference(ctx, refName)
+		if err == nil {
+			return refName, nil
+		}
+		if !errors.Is(err, storage.ErrRefNotFound) {
+			return "", err
+		}
+	}
+
+	return "", fmt.Errorf("unknown revision '%s': %w", name, storage.ErrRefNotFound)
+}
+
+// isRootRefName reports whether name is looked up as is, outside refs/.
+// Like git, this is limited to upper-case names ending in HEAD, such as
+// HEAD or ORIG_HEAD, so that "config" or "objects/..." never resolve.
+func isRootRefName(name string) bool {
+	if !strings.HasSuffix(name, "HEAD") {
+		return false
+	}
+	for _, c := range name {
+		if (c < 'A' || c > 'Z') && c != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// abbrev shortens an object hash for display. An empty hash, as recorded
+// for a reference that did not exist, is shown as the abbreviated zero hash.
+func abbrev(hash string) string {
+	if hash == "" {
+		return "0000000"
+	}
+	if len(hash) > 7 {
+		return hash[:7]
+	}
+	return hash
+}
+
+// isHash reports whether s is a full hexadecimal object hash
+func isHash(s string) bool {
+	if len(s) != 40 {
+		return false
+	}
+	for _, c := range s {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
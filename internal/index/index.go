@@ -0,0 +1,385 @@
+// Package index implements the staging area of a Gitk repository, stored in
+// Git's DIRC index file format (version 2).
+package index
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mindkit-xyz/mindkit-gitk/internal/storage"
+)
+
+const (
+	signature = "DIRC"
+	version   = 2
+
+	// entryHeaderSize is the size of the fixed-length part of an entry
+	entryHeaderSize = 62
+
+	// nameMask masks the name length stored in the entry flags
+	nameMask = 0x0fff
+
+	// extendedFlag marks entries followed by a second flags field (version 3)
+	extendedFlag = 0x4000
+)
+
+// Entry is a single staged file
+type Entry struct {
+	CTime time.Time
+	MTime time.Time
+	Dev   uint32
+	Ino   uint32
+	Mode  storage.FileMode
+	UID   uint32
+	GID   uint32
+	Size  uint32
+	Hash  string
+	Name  string
+}
+
+// Index is the list of staged files, sorted by name
+type Index struct {
+	Entries []*Entry
+
+	// modTime is the modification time of the index file when it was read.
+	// Entries modified at or after it cannot be trusted by their stat data.
+	modTime time.Time
+
+	// lock, if not nil, is the lock file taken by Lock, which Write writes
+	// the index to
+	lock *os.File
+}
+
+// Read reads the index file at path. A missing file yields an empty index.
+func Read(path string) (*Index, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return &Index{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read index: %w", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat index: %w", err)
+	}
+
+	idx, err := Decode(data)
+	if err != nil {
+		return nil, err
+	}
+	idx.modTime = info.ModTime()
+
+	return idx, nil
+}
+
+// Lock takes the lock of the index file at path, as git does, and reads
+// the index. The lock is held until the index is written with Write or
+// released with Unlock, so that a concurrent update fails instead of one of
+// them being lost.
+func Lock(path string) (*Index, error) {
+	lockPath := path + ".lock"
+	f, err := os.OpenFile(lockPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if errors.Is(err, fs.ErrExist) {
+		return nil, fmt.Errorf("failed to lock index: another gitk process seems to be running "+
+			"(remove %s if it was interrupted): %w", lockPath, err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock index: %w", err)
+	}
+
+	idx, err := Read(path)
+	if err != nil {
+		f.Close()
+		os.Remove(lockPath)
+		return nil, err
+	}
+	idx.lock = f
+
+	return idx, nil
+}
+
+// Unlock releases the lock taken by Lock without writing the index. It does
+// nothing once the index is written.
+func (idx *Index) Unlock() {
+	if idx.lock == nil {
+		return
+	}
+	idx.lock.Close()
+	os.Remove(idx.lock.Name())
+	idx.lock = nil
+}
+
+// Write atomically replaces the index file at path. An index read by Lock
+// is written to its lock file, which releases the lock; otherwise the lock
+// is taken for the time of the write.
+func (idx *Index) Write(path string) error {
+	// Hold the lock file while writing, as git does, so concurrent
+	// writers fail instead of losing each other's updates
+	f := idx.lock
+	idx.lock = nil
+	if f == nil {
+		var err error
+		if f, err = os.OpenFile(path+".lock", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644); err != nil {
+			return fmt.Errorf("failed to lock index: %w", err)
+		}
+	}
+	lockPath := f.Name()
+	defer os.Remove(lockPath)
+
+	if _, err := f.Write(idx.Encode()); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write index: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write index: %w", err)
+	}
+
+	if err := os.Rename(lockPath, path); err != nil {
+		return fmt.Errorf("failed to write index: %w", err)
+	}
+
+	return nil
+}
+
+// Decode parses an index file
+func Decode(data []byte) (*Index, error) {
+	if len(data) < 12+sha1.Size {
+		return nil, fmt.Errorf("index file is too short")
+	}
+
+	body, checksum := data[:len(data)-sha1.Size], data[len(data)-sha1.Size:]
+	if sum := sha1.Sum(body); !bytes.Equal(sum[:], checksum) {
+		return nil, fmt.Errorf("index file checksum mismatch")
+	}
+
+	if string(body[:4]) != signature {
+		return nil, fmt.Errorf("invalid index signature %q", body[:4])
+	}
+	v := binary.BigEndian.Uint32(body[4:8])
+	if v != 2 && v != 3 {
+		return nil, fmt.Errorf("unsupported index version %d", v)
+	}
+	count := binary.BigEndian.Uint32(body[8:12])
+
+	idx := &Index{}
+	buf := body[12:]
+	for i := uint32(0); i < count; i++ {
+		entry, n, err := decodeEntry(buf)
+		if err != nil {
+			return nil, err
+		}
+		idx.Entries = append(idx.Entries, entry)
+		buf = buf[n:]
+	}
+
+	// Skip extensions. Those with a lowercase signature are required to
+	// understand the index, so refuse to continue without support for them.
+	for len(buf) > 0 {
+		if len(buf) < 8 {
+			return nil, fmt.Errorf("truncated index extension")
+		}
+		ext := string(buf[:4])
+		size := binary.BigEndian.Uint32(buf[4:8])
+		if ext[0] < 'A' || ext[0] > 'Z' {
+			return nil, fmt.Errorf("unsupported index extension %q", ext)
+		}
+		if uint64(len(buf)-8) < uint64(size) {
+			return nil, fmt.Errorf("truncated index extension %q", ext)
+		}
+		buf = buf[8+size:]
+	}
+
+	return idx, nil
+}
+
+func decodeEntry(buf []byte) (*Entry, int, error) {
+	if len(buf) < entryHeaderSize {
+		return nil, 0, fmt.Errorf("truncated index entry")
+	}
+
+	be := binary.BigEndian
+	entry := &Entry{
+		CTime: time.Unix(int64(be.Uint32(buf[0:])), int64(be.Uint32(buf[4:]))),
+		MTime: time.Unix(int64(be.Uint32(buf[8:])), int64(be.Uint32(buf[12:]))),
+		Dev:   be.Uint32(buf[16:]),
+		Ino:   be.Uint32(buf[20:]),
+		Mode:  storage.FileMode(be.Uint32(buf[24:])),
+		UID:   be.Uint32(buf[28:]),
+		GID:   be.Uint32(buf[32:]),
+		Size:  be.Uint32(buf[36:]),
+		Hash:  hex.EncodeToString(buf[40:60]),
+	}
+	flags := be.Uint16(buf[60:])
+
+	offset := entryHeaderSize
+	if flags&extendedFlag != 0 {
+		offset += 2
+	}
+
+	nul := bytes.IndexByte(buf[offset:], 0)
+	if nul < 0 {
+		return nil, 0, fmt.Errorf("truncated index entry name")
+	}
+	entry.Name = string(buf[offset : offset+nul])
+
+	// Entries are NUL-padded to a multiple of eight bytes
+	n := (offset + nul + 8) &^ 7
+	if n > len(buf) {
+		return nil, 0, fmt.Errorf("truncated index entry %q", entry.Name)
+	}
+
+	return entry, n, nil
+}
+
+// Encode serializes the index in version 2 format
+func (idx *Index) Encode() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(signature)
+	binary.Write(&buf, binary.BigEndian, uint32(version))
+	binary.Write(&buf, binary.BigEndian, uint32(len(idx.Entries)))
+
+	for _, entry := range idx.Entries {
+		var header [entryHeaderSize]byte
+		be := binary.BigEndian
+		be.PutUint32(header[0:], uint32(entry.CTime.Unix()))
+		be.PutUint32(header[4:], uint32(entry.CTime.Nanosecond()))
+		be.PutUint32(header[8:], uint32(entry.MTime.Unix()))
+		be.PutUint32(header[12:], uint32(entry.MTime.Nanosecond()))
+		be.PutUint32(header[16:], entry.Dev)
+		be.PutUint32(header[20:], entry.Ino)
+		be.PutUint32(header[24:], uint32(entry.Mode))
+		be.PutUint32(header[28:], entry.UID)
+		be.PutUint32(header[32:], entry.GID)
+		be.PutUint32(header[36:], entry.Size)
+		hex.Decode(header[40:60], []byte(entry.Hash))
+
+		nameLen := len(entry.Name)
+		if nameLen > nameMask {
+			nameLen = nameMask
+		}
+		be.PutUint16(header[60:], uint16(nameLen))
+
+		buf.Write(header[:])
+		buf.WriteString(entry.Name)
+		padding := (entryHeaderSize+len(entry.Name)+8)&^7 - entryHeaderSize - len(entry.Name)
+		buf.Write(make([]byte, padding))
+	}
+
+	sum := sha1.Sum(buf.Bytes())
+	buf.Write(sum[:])
+	return buf.Bytes()
+}
+
+// Entry returns the entry for the file with the given name
+func (idx *Index) Entry(name string) (*Entry, bool) {
+	i, found := idx.search(name)
+	if !found {
+		return nil, false
+	}
+	return idx.Entries[i], true
+}
+
+// Add adds an entry, replacing any existing entry for the same file. Like
+// git, it also removes the entries the new one conflicts with: a file at one
+// of its parent directories, or the files below it if it was a directory.
+func (idx *Index) Add(entry *Entry) {
+	for dir := path.Dir(entry.Name); dir != "."; dir = path.Dir(dir) {
+		idx.Remove(dir)
+	}
+
+	// The files below a directory are adjacent in the sorted index
+	start, _ := idx.search(entry.Name + "/")
+	end := start
+	for end < len(idx.Entries) && strings.HasPrefix(idx.Entries[end].Name, entry.Name+"/") {
+		end++
+	}
+	idx.Entries = append(idx.Entries[:start], idx.Entries[end:]...)
+
+	i, found := idx.search(entry.Name)
+	if found {
+		idx.Entries[i] = entry
+		return
+	}
+	idx.Entries = append(idx.Entries, nil)
+	copy(idx.Entries[i+1:], idx.Entries[i:])
+	idx.Entries[i] = entry
+}
+
+// Remove removes the entry for the file with the given name
+func (idx *Index) Remove(name string) bool {
+	i, found := idx.search(name)
+	if !found {
+		return false
+	}
+	idx.Entries = append(idx.Entries[:i], idx.Entries[i+1:]...)
+	return true
+}
+
+// UpToDate reports whether the file described by info is known to be
+// unchanged since entry was recorded, judging by its stat data alone
+func (idx *Index) UpToDate(entry *Entry, info fs.FileInfo) bool {
+	// A file modified in the same instant the index was written may have
+	// changed again without its timestamp moving ("racy git")
+	if !idx.modTime.IsZero() && !entry.MTime.Before(idx.modTime) {
+		return false
+	}
+
+	current := NewEntry(entry.Name, info, entry.Hash)
+	return current.CTime.Equal(entry.CTime) &&
+		current.MTime.Equal(entry.MTime) &&
+		current.Dev == entry.Dev &&
+		current.Ino == entry.Ino &&
+		current.Mode == entry.Mode &&
+		current.UID == entry.UID &&
+		current.GID == entry.GID &&
+		current.Size == entry.Size
+}
+
+// search returns the position of the entry named name, or where it would be inserted
+func (idx *Index) search(name string) (int, bool) {
+	i := sort.Search(len(idx.Entries), func(i int) bool {
+		return idx.Entries[i].Name >= name
+	})
+	return i, i < len(idx.Entries) && idx.Entries[i].Name == name
+}
+
+// NewEntry creates an index entry for the file described by info, which must
+// come from os.Lstat. The name is the slash-separated path relative to the
+// repository root.
+func NewEntry(name string, info fs.FileInfo, hash string) *Entry {
+	entry := &Entry{
+		MTime: info.ModTime(),
+		Mode:  fileMode(info),
+		Size:  uint32(info.Size()),
+		Hash:  hash,
+		Name:  filepath.ToSlash(name),
+	}
+	entry.CTime = entry.MTime
+	fillStat(entry, info)
+	return entry
+}
+
+// fileMode returns the tree entry mode Git records for a file
+func fileMode(info fs.FileInfo) storage.FileMode {
+	switch {
+	case info.Mode()&fs.ModeSymlink != 0:
+		return storage.ModeSymlink
+	case info.Mode()&0111 != 0:
+		return storage.ModeExecutable
+	default:
+		return storage.ModeBlob
+	}
+}
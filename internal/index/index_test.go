@@ -0,0 +1,81 @@
+package index
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/mindkit-xyz/mindkit-gitk/internal/storage"
+)
+
+func names(idx *Index) []string {
+	var names []string
+	for _, entry := range idx.Entries {
+		names = append(names, entry.Name)
+	}
+	return names
+}
+
+func TestAddReplacesConflictingEntries(t *testing.T) {
+	blob := storage.HashObject(storage.BlobObject, nil)
+	idx := &Index{}
+	for _, name := range []string{"a", "a-b", "a.txt", "b/c", "b/d/e", "bc"} {
+		idx.Add(&Entry{Name: name, Mode: storage.ModeBlob, Hash: blob})
+	}
+
+	// The file a becomes a directory, and the directory b a file
+	idx.Add(&Entry{Name: "a/x", Mode: storage.ModeBlob, Hash: blob})
+	idx.Add(&Entry{Name: "b", Mode: storage.ModeBlob, Hash: blob})
+
+	want := []string{"a-b", "a.txt", "a/x", "b", "bc"}
+	if got := names(idx); !reflect.DeepEqual(got, want) {
+		t.Errorf("index holds %q, want %q", got, want)
+	}
+}
+
+func TestWriteTreeRefusesFileAndDirectory(t *testing.T) {
+	store := storage.NewObjectStorage(storage.NewLocalBackend(t.TempDir()), "")
+	blob := storage.HashObject(storage.BlobObject, nil)
+
+	// As left by an older gitk, which did not replace conflicting entries
+	idx := &Index{Entries: []*Entry{
+		{Name: "a", Mode: storage.ModeBlob, Hash: blob},
+		{Name: "a.txt", Mode: storage.ModeBlob, Hash: blob},
+		{Name: "a/b", Mode: storage.ModeBlob, Hash: blob},
+	}}
+	if hash, err := idx.WriteTree(context.Background(), store); err == nil {
+		t.Fatalf("WriteTree = %s, want an error", hash)
+	}
+}
+
+func TestLockHoldsIndexUntilWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index")
+
+	idx, err := Lock(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Lock(path); err == nil {
+		t.Fatal("locked the index twice")
+	}
+
+	idx.Add(&Entry{Name: "a", Mode: storage.ModeBlob, Hash: storage.HashObject(storage.BlobObject, nil)})
+	if err := idx.Write(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + ".lock"); !os.IsNotExist(err) {
+		t.Errorf("lock file left after Write: %v", err)
+	}
+
+	// Written and unlocked, the index can be locked again
+	idx, err = Lock(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Unlock()
+	if got := names(idx); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Errorf("index holds %q, want [a]", got)
+	}
+}
@@ -0,0 +1,20 @@
+package index
+
+import (
+	"io/fs"
+	"syscall"
+	"time"
+)
+
+// fillStat copies the platform-specific stat data of info into entry
+func fillStat(entry *Entry, info fs.FileInfo) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+	entry.CTime = time.Unix(int64(st.Ctim.Sec), int64(st.Ctim.Nsec))
+	entry.Dev = uint32(st.Dev)
+	entry.Ino = uint32(st.Ino)
+	entry.UID = st.Uid
+	entry.GID = st.Gid
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin
+
+package index
+
+import (
+	"io/fs"
+)
+
+// fillStat is a no-op on platforms without inode data; change detection
+// then relies on the modification time and size
+func fillStat(entry *Entry, info fs.FileInfo) {}
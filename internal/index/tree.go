@@ -0,0 +1,63 @@
+package index
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/mindkit-xyz/mindkit-gitk/internal/storage"
+)
+
+// WriteTree stores the tree objects describing the staged files, one per
+// directory, and returns the hash of the root tree
+func (idx *Index) WriteTree(ctx context.Context, store *storage.ObjectStorage) (string, error) {
+	return writeTree(ctx, store, idx.Entries, "")
+}
+
+// writeTree stores the tree for the directory prefix, given the sorted
+// entries of all files below it. A name that is both a file and a directory
+// is refused, as no tree can hold it.
+func writeTree(ctx context.Context, store *storage.ObjectStorage, entries []*Entry, prefix string) (string, error) {
+	tree := &storage.Tree{}
+	files := make(map[string]bool)
+	for i := 0; i < len(entries); {
+		name := strings.TrimPrefix(entries[i].Name, prefix)
+
+		dir, _, isNested := strings.Cut(name, "/")
+		if !isNested {
+			files[name] = true
+			tree.Entries = append(tree.Entries, storage.TreeEntry{
+				Mode: entries[i].Mode,
+				Name: name,
+				Hash: entries[i].Hash,
+			})
+			i++
+			continue
+		}
+
+		// A file sorts before the files below a directory of the same name
+		if files[dir] {
+			return "", fmt.Errorf("invalid index: %s is both a file and a directory", prefix+dir)
+		}
+
+		// Entries below the same subdirectory are adjacent in the sorted index
+		subPrefix := prefix + dir + "/"
+		j := i
+		for j < len(entries) && strings.HasPrefix(entries[j].Name, subPrefix) {
+			j++
+		}
+
+		hash, err := writeTree(ctx, store, entries[i:j], subPrefix)
+		if err != nil {
+			return "", err
+		}
+		tree.Entries = append(tree.Entries, storage.TreeEntry{
+			Mode: storage.ModeTree,
+			Name: dir,
+			Hash: hash,
+		})
+		i = j
+	}
+
+	return store.StoreObject(ctx, tree)
+}
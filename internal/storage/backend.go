@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"context"
+	"io"
+)
+
+// Backend is a flat key/value blob store that ObjectStorage and
+// ReferenceStorage keep their data in. Keys are slash-separated paths.
+// Operations on a key that does not exist fail with an error matching
+// ErrObjectNotFound and fs.ErrNotExist; other failures are classified with
+// the error kinds in errors.go where possible.
+type Backend interface {
+	// Put stores data under key, replacing any data already stored there
+	Put(ctx context.Context, key string, data []byte) error
+
+	// PutFrom stores the data read from r under key, like Put. Nothing is
+	// stored if reading r fails.
+	PutFrom(ctx context.Context, key string, r io.Reader) error
+
+	// Create stores data under key if the key does not exist yet. It fails
+	// with an error matching ErrAlreadyExists otherwise, so only one of several
+	// concurrent callers can succeed.
+	Create(ctx context.Context, key string, data []byte) error
+
+	// CreateBatch stores each entry like Create, in one round trip where the
+	// backend supports it. If it fails, some of the entries may have been
+	// stored; ErrAlreadyExists means that at least one key existed before.
+	CreateBatch(ctx context.Context, entries []KeyData) error
+
+	// Get retrieves the data stored under key
+	Get(ctx context.Context, key string) ([]byte, error)
+
+	// Open returns a reader of the data stored under key, which the caller
+	// must close
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+
+	// GetRange retrieves length bytes of the data stored under key, starting
+	// at offset. Fewer bytes are returned if the data ends before.
+	GetRange(ctx context.Context, key string, offset, length int64) ([]byte, error)
+
+	// Head returns metadata about the data stored under key without
+	// retrieving it
+	Head(ctx context.Context, key string) (*KeyInfo, error)
+
+	// Delete removes the data stored under key
+	Delete(ctx context.Context, key string) error
+
+	// Walk calls fn for every key that begins with prefix, fetching keys as
+	// it goes rather than collecting them first. Walk stops at the first
+	// error returned by fn and returns it.
+	Walk(ctx context.Context, prefix string, fn func(key string) error) error
+}
+
+// KeyData is data to be stored under a key
+type KeyData struct {
+	Key  string
+	Data []byte
+}
+
+// KeyInfo describes the data stored under a key
+type KeyInfo struct {
+	Key  string
+	Size int64
+}
@@ -0,0 +1,234 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Defaults of BatchOptions
+const (
+	DefaultConcurrency = 8
+	DefaultBatchSize   = 50
+)
+
+// ObjectLoader returns the type and size of the object hash and a reader
+// of its content, which the caller closes, for StoreBatch to upload.
+// ObjectStorage.Open is one.
+type ObjectLoader func(ctx context.Context, hash string) (string, int64, io.ReadCloser, error)
+
+// maxBatchObjectSize is the size from which StoreBatch streams an object on
+// its own rather than holding it in memory to create it with others
+const maxBatchObjectSize = 1 << 20
+
+// BatchOptions configures StoreBatch
+type BatchOptions struct {
+	// Concurrency is the number of batches stored in parallel. Zero means
+	// DefaultConcurrency.
+	Concurrency int
+
+	// BatchSize is the number of objects created together, in a single
+	// transaction on Greenfield. Zero means DefaultBatchSize.
+	BatchSize int
+
+	// Progress, if not nil, is called after each object has been stored,
+	// with whether it was uploaded or skipped. Calls never overlap.
+	Progress func(hash string, uploaded bool)
+}
+
+// BatchResult counts the objects stored by StoreBatch
+type BatchResult struct {
+	Uploaded int
+	Skipped  int
+}
+
+// StoreBatch stores the objects hashes, loading each through load. The
+// objects are split into batches that are created with one backend call
+// each, by a pool of workers. StoreBatch stops at the first failure, or when
+// ctx is canceled, and returns that error; objects stored until then stay
+// stored.
+func (s *ObjectStorage) StoreBatch(ctx context.Context, hashes []string, load ObjectLoader, opts BatchOptions) (BatchResult, error) {
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultConcurrency
+	}
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mu       sync.Mutex
+		result   BatchResult
+		firstErr error
+	)
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+	}
+
+	queue := make(chan []string)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range queue {
+				if ctx.Err() != nil {
+					continue
+				}
+
+				uploaded, err := s.storeBatch(ctx, batch, load)
+				if err != nil {
+					fail(err)
+					continue
+				}
+
+				mu.Lock()
+				for i, hash := range batch {
+					if uploaded[i] {
+						result.Uploaded++
+					} else {
+						result.Skipped++
+					}
+					if opts.Progress != nil {
+						opts.Progress(hash, uploaded[i])
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+feed:
+	for start := 0; start < len(hashes); start += batchSize {
+		end := start + batchSize
+		if end > len(hashes) {
+			end = len(hashes)
+		}
+
+		select {
+		case queue <- hashes[start:end]:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	if firstErr != nil {
+		return result, firstErr
+	}
+	// Canceled by the caller rather than by a failure
+	if err := ctx.Err(); err != nil {
+		return result, err
+	}
+
+	return result, nil
+}
+
+// pendingObject is an object of a batch that is not stored yet
+type pendingObject struct {
+	index   int
+	objType string
+	data    []byte
+}
+
+// storeBatch stores the objects hashes with a single CreateBatch call and
+// reports which of them were uploaded. Large objects are streamed to the
+// backend one by one instead.
+func (s *ObjectStorage) storeBatch(ctx context.Context, hashes []string, load ObjectLoader) ([]bool, error) {
+	uploaded := make([]bool, len(hashes))
+
+	var pending []pendingObject
+	var entries []KeyData
+	for i, hash := range hashes {
+		stored, err := s.isStored(ctx, hash)
+		if err != nil {
+			return nil, err
+		}
+		if stored {
+			continue
+		}
+
+		objType, size, content, err := load(ctx, hash)
+		if err != nil {
+			return nil, err
+		}
+		if size > maxBatchObjectSize {
+			uploaded[i], err = s.StoreFrom(ctx, hash, objType, size, content)
+			content.Close()
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		data, err := readContent(content, size)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load object %s: %w", hash, err)
+		}
+		if got := HashObject(objType, data); got != hash {
+			return nil, fmt.Errorf("failed to load object %s: content hashes to %s", hash, got)
+		}
+
+		raw, err := EncodeLooseObject(objType, data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode object %s: %w", hash, err)
+		}
+
+		pending = append(pending, pendingObject{index: i, objType: objType, data: data})
+		entries = append(entries, KeyData{Key: s.objectPath(hash), Data: raw})
+	}
+	if len(entries) == 0 {
+		return uploaded, nil
+	}
+
+	err := s.backend.CreateBatch(ctx, entries)
+	if errors.Is(err, ErrAlreadyExists) {
+		// Some object was stored meanwhile or left behind by an interrupted
+		// upload, which one by one is handled by Store
+		for _, obj := range pending {
+			hash := hashes[obj.index]
+			if uploaded[obj.index], err = s.Store(ctx, hash, obj.objType, obj.data); err != nil {
+				return nil, err
+			}
+		}
+		return uploaded, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to store %d objects: %w", len(entries), err)
+	}
+
+	for _, obj := range pending {
+		s.markHave(hashes[obj.index])
+		uploaded[obj.index] = true
+	}
+
+	return uploaded, nil
+}
+
+// readContent reads the size bytes of content of an object and closes it
+func readContent(content io.ReadCloser, size int64) ([]byte, error) {
+	defer content.Close()
+
+	// Reading to the end lets readers such as the one of ObjectStorage.Open
+	// verify the content
+	data, err := io.ReadAll(io.LimitReader(content, size+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) != size {
+		return nil, fmt.Errorf("object has %d bytes, expected %d", len(data), size)
+	}
+
+	return data, nil
+}
@@ -0,0 +1,131 @@
+package storage_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/bnb-chain/greenfield-go-sdk/types"
+	"github.com/mindkit-xyz/mindkit-gitk/internal/storage"
+	"github.com/mindkit-xyz/mindkit-gitk/internal/storage/greenfieldtest"
+)
+
+// blobLoader loads the blobs of contents, an ObjectLoader
+func blobLoader(contents map[string][]byte) storage.ObjectLoader {
+	return func(ctx context.Context, hash string) (string, int64, io.ReadCloser, error) {
+		data, ok := contents[hash]
+		if !ok {
+			return "", 0, nil, fmt.Errorf("object %s: %w", hash, storage.ErrObjectNotFound)
+		}
+		return storage.BlobObject, int64(len(data)), io.NopCloser(bytes.NewReader(data)), nil
+	}
+}
+
+func TestStoreBatchStreamsLargeObjects(t *testing.T) {
+	ctx := context.Background()
+	client, backend := greenfieldtest.NewBackend()
+	store := storage.NewObjectStorage(backend, "repo")
+
+	contents := make(map[string][]byte)
+	var hashes []string
+	add := func(data []byte) {
+		hash := storage.HashObject(storage.BlobObject, data)
+		contents[hash] = data
+		hashes = append(hashes, hash)
+	}
+	for i := 0; i < 10; i++ {
+		add([]byte(fmt.Sprintf("small %d\n", i)))
+	}
+	add(bytes.Repeat([]byte("large\n"), 1<<20))
+
+	result, err := store.StoreBatch(ctx, hashes, blobLoader(contents), storage.BatchOptions{Concurrency: 1, BatchSize: len(hashes)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Uploaded != len(hashes) {
+		t.Fatalf("uploaded %d objects, want %d", result.Uploaded, len(hashes))
+	}
+
+	// The small objects are created together, the large one on its own
+	if got := client.Transactions(); got != 2 {
+		t.Errorf("sent %d transactions, want 2", got)
+	}
+	for hash, data := range contents {
+		if _, got, err := store.Get(ctx, hash); err != nil || !bytes.Equal(got, data) {
+			t.Errorf("object %s: got %d bytes, %v; want %d bytes", hash, len(got), err, len(data))
+		}
+	}
+}
+
+func TestStoreBatchRejectsCorruptContent(t *testing.T) {
+	ctx := context.Background()
+	client, backend := greenfieldtest.NewBackend()
+	store := storage.NewObjectStorage(backend, "repo")
+
+	hash := storage.HashObject(storage.BlobObject, []byte("expected\n"))
+	load := blobLoader(map[string][]byte{hash: []byte("different\n")})
+	if _, err := store.StoreBatch(ctx, []string{hash}, load, storage.BatchOptions{}); err == nil {
+		t.Fatal("stored content that does not match its hash")
+	}
+	if objects := client.Objects(greenfieldtest.Bucket); len(objects) != 0 {
+		t.Errorf("bucket holds %q", objects)
+	}
+}
+
+func TestGreenfieldPutFromSpoolsStreams(t *testing.T) {
+	ctx := context.Background()
+	_, backend := greenfieldtest.NewBackend()
+
+	// A reader that cannot seek, like the pipe StoreFrom uploads from
+	for _, data := range [][]byte{
+		bytes.Repeat([]byte("first\n"), 1<<19),
+		bytes.Repeat([]byte("second\n"), 1<<19),
+	} {
+		if err := backend.PutFrom(ctx, "key", io.MultiReader(bytes.NewReader(data))); err != nil {
+			t.Fatal(err)
+		}
+		rc, err := backend.Open(ctx, "key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("read %d bytes, %v; want %d bytes", len(got), err, len(data))
+		}
+	}
+}
+
+func TestGreenfieldCreateBatchStopsAtFirstFailure(t *testing.T) {
+	ctx := context.Background()
+	client, backend := greenfieldtest.NewBackend()
+
+	entries := make([]storage.KeyData, 100)
+	for i := range entries {
+		key := fmt.Sprintf("objects/%03d", i)
+		entries[i] = storage.KeyData{Key: key, Data: []byte(key)}
+	}
+
+	// The approval of the first object is refused
+	denied := types.ErrResponse{StatusCode: http.StatusForbidden, Code: "AccessDenied"}
+	client.FailNext("GetCreateObjectApproval", denied)
+	err := backend.CreateBatch(ctx, entries)
+	if !errors.Is(err, storage.ErrPermissionDenied) {
+		t.Fatalf("CreateBatch = %v, want the refused approval", err)
+	}
+
+	// Approvals under way are canceled and no more are requested
+	if got := client.Calls("GetCreateObjectApproval"); got >= len(entries) {
+		t.Errorf("requested %d approvals after the first was refused", got)
+	}
+	if got := client.Calls("BroadcastTx"); got != 0 {
+		t.Errorf("broadcast %d transactions", got)
+	}
+	if objects := client.Objects(greenfieldtest.Bucket); len(objects) != 0 {
+		t.Errorf("bucket holds %d objects", len(objects))
+	}
+}
@@ -0,0 +1,21 @@
+package storage
+
+// Blob is a Git blob object holding the contents of a file
+type Blob struct {
+	Data []byte
+}
+
+// Type returns the Git object type of the blob
+func (b *Blob) Type() string {
+	return BlobObject
+}
+
+// Serialize returns the blob contents
+func (b *Blob) Serialize() ([]byte, error) {
+	return b.Data, nil
+}
+
+// ParseBlob parses the contents of a blob object
+func ParseBlob(data []byte) (*Blob, error) {
+	return &Blob{Data: data}, nil
+}
@@ -0,0 +1,239 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultCacheSize is the default size limit of ObjectCache
+const DefaultCacheSize = 1 << 30
+
+// ObjectCache keeps Git objects fetched from remote storage on the local
+// disk, in loose object format. Objects are content-addressed, so the cache
+// is keyed by hash alone and can be shared by all repositories and
+// processes. When the objects take up more than the size limit, those used
+// least recently are evicted.
+type ObjectCache struct {
+	dir   string
+	limit int64
+
+	// mu serializes the updates of the recorded size within this process
+	mu sync.Mutex
+}
+
+// DefaultCacheDir returns the gitk directory in the user's cache directory,
+// such as ~/.cache/gitk on Linux
+func DefaultCacheDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "gitk"), nil
+}
+
+// NewObjectCache creates a cache in dir holding up to limit bytes
+func NewObjectCache(dir string, limit int64) *ObjectCache {
+	return &ObjectCache{
+		dir:   dir,
+		limit: limit,
+	}
+}
+
+func (c *ObjectCache) objectPath(hash string) string {
+	return filepath.Join(c.dir, "objects", hash[:2], hash[2:])
+}
+
+// sizePath is the file recording the total size of the cached objects
+func (c *ObjectCache) sizePath() string {
+	return filepath.Join(c.dir, "size")
+}
+
+// Get returns the type and content of the object hash if it is cached. An
+// entry that does not hash to its name, being damaged, is removed and
+// reported as missing.
+func (c *ObjectCache) Get(hash string) (string, []byte, bool) {
+	if len(hash) != 40 {
+		return "", nil, false
+	}
+
+	objectPath := c.objectPath(hash)
+	raw, err := os.ReadFile(objectPath)
+	if err != nil {
+		return "", nil, false
+	}
+
+	objType, data, err := DecodeLooseObject(raw)
+	if err != nil || HashObject(objType, data) != hash {
+		os.Remove(objectPath)
+		return "", nil, false
+	}
+
+	// The modification time tells eviction when the object was last used
+	now := time.Now()
+	os.Chtimes(objectPath, now, now)
+
+	return objType, data, true
+}
+
+// Put adds the object hash to the cache, evicting the objects used least
+// recently if the cache grows over its limit. An object already cached is
+// only marked as used.
+func (c *ObjectCache) Put(hash, objType string, data []byte) error {
+	if len(hash) != 40 {
+		return fmt.Errorf("invalid object hash %q", hash)
+	}
+
+	objectPath := c.objectPath(hash)
+	if _, err := os.Stat(objectPath); err == nil {
+		now := time.Now()
+		os.Chtimes(objectPath, now, now)
+		return nil
+	}
+
+	raw, err := EncodeLooseObject(objType, data)
+	if err != nil {
+		return err
+	}
+	if int64(len(raw)) > c.limit {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(objectPath), 0755); err != nil {
+		return fmt.Errorf("failed to cache object %s: %w", hash, err)
+	}
+	if err := writeCacheFile(objectPath, raw); err != nil {
+		return fmt.Errorf("failed to cache object %s: %w", hash, err)
+	}
+
+	return c.grow(int64(len(raw)))
+}
+
+// writeCacheFile writes data to a temporary file renamed to path, so that
+// concurrent readers never see a partial file
+func writeCacheFile(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), tempPattern)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// grow accounts for n more bytes in the cache and evicts objects if it is
+// over its limit. The total is recorded in a file, so that processes learn
+// it without scanning the cache. Processes growing the cache at the same
+// time may miss some of each other's bytes, until eviction rescans it.
+func (c *ObjectCache) grow(n int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	size, err := c.readSize()
+	if err != nil {
+		// Not recorded yet, or damaged
+		return c.evict()
+	}
+	size += n
+	if size > c.limit {
+		return c.evict()
+	}
+
+	return c.writeSize(size)
+}
+
+// readSize returns the recorded total size of the cached objects
+func (c *ObjectCache) readSize() (int64, error) {
+	data, err := os.ReadFile(c.sizePath())
+	if err != nil {
+		return 0, err
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid cache size %q", data)
+	}
+	return size, nil
+}
+
+// writeSize records the total size of the cached objects
+func (c *ObjectCache) writeSize(size int64) error {
+	if err := writeCacheFile(c.sizePath(), []byte(strconv.FormatInt(size, 10)+"\n")); err != nil {
+		return fmt.Errorf("failed to record object cache size: %w", err)
+	}
+	return nil
+}
+
+// cachedFile is an object file found by evict
+type cachedFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// evict scans the cache, which other processes may have changed, and
+// removes the objects used least recently until it is back to 90% of its
+// limit, so that eviction does not run again on every Put
+func (c *ObjectCache) evict() error {
+	var files []cachedFile
+	var total int64
+	err := filepath.WalkDir(filepath.Join(c.dir, "objects"), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if temp, _ := filepath.Match(tempPattern, d.Name()); temp {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			// Evicted by another process meanwhile
+			return nil
+		}
+		files = append(files, cachedFile{path: path, size: info.Size(), modTime: info.ModTime()})
+		total += info.Size()
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to scan object cache: %w", err)
+	}
+
+	if total > c.limit {
+		sort.Slice(files, func(i, j int) bool {
+			return files[i].modTime.Before(files[j].modTime)
+		})
+
+		target := c.limit / 10 * 9
+		for _, file := range files {
+			if total <= target {
+				break
+			}
+			if err := os.Remove(file.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return fmt.Errorf("failed to evict cached object: %w", err)
+			}
+			total -= file.size
+		}
+	}
+
+	return c.writeSize(total)
+}
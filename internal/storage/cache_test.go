@@ -0,0 +1,175 @@
+package storage_test
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mindkit-xyz/mindkit-gitk/internal/storage"
+)
+
+// cachedPath is where an ObjectCache in dir keeps the object hash
+func cachedPath(dir, hash string) string {
+	return filepath.Join(dir, "objects", hash[:2], hash[2:])
+}
+
+// randomBlob returns n bytes that do not compress, different for each seed
+func randomBlob(n int, seed int64) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+// looseSize is the size of data stored as a loose blob
+func looseSize(t *testing.T, data []byte) int64 {
+	t.Helper()
+
+	raw, err := storage.EncodeLooseObject(storage.BlobObject, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return int64(len(raw))
+}
+
+func TestObjectCacheGet(t *testing.T) {
+	cache := storage.NewObjectCache(t.TempDir(), storage.DefaultCacheSize)
+	data := []byte("cached\n")
+	hash := storage.HashObject(storage.BlobObject, data)
+
+	if _, _, ok := cache.Get(hash); ok {
+		t.Fatal("Get found an object never cached")
+	}
+	if err := cache.Put(hash, storage.BlobObject, data); err != nil {
+		t.Fatal(err)
+	}
+	objType, got, ok := cache.Get(hash)
+	if !ok || objType != storage.BlobObject || !bytes.Equal(got, data) {
+		t.Fatalf("Get = %s, %q, %v; want the cached blob", objType, got, ok)
+	}
+}
+
+func TestObjectCacheRemovesDamagedObject(t *testing.T) {
+	dir := t.TempDir()
+	cache := storage.NewObjectCache(dir, storage.DefaultCacheSize)
+	data := []byte("cached\n")
+	hash := storage.HashObject(storage.BlobObject, data)
+	if err := cache.Put(hash, storage.BlobObject, data); err != nil {
+		t.Fatal(err)
+	}
+
+	// A well-formed object whose content does not match its name
+	raw, err := storage.EncodeLooseObject(storage.BlobObject, []byte("damaged\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(cachedPath(dir, hash), raw, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, ok := cache.Get(hash); ok {
+		t.Fatal("Get returned a damaged object")
+	}
+	if _, err := os.Stat(cachedPath(dir, hash)); !os.IsNotExist(err) {
+		t.Fatalf("damaged object left in the cache: %v", err)
+	}
+}
+
+func TestObjectCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	dir := t.TempDir()
+	var hashes []string
+	var blobs [][]byte
+	var limit int64
+	for i := 0; i < 4; i++ {
+		data := randomBlob(1000, int64(i))
+		hashes = append(hashes, storage.HashObject(storage.BlobObject, data))
+		blobs = append(blobs, data)
+		if i < 3 {
+			limit += looseSize(t, data)
+		}
+	}
+	// Room for three objects, and the 90% eviction leaves two
+	cache := storage.NewObjectCache(dir, limit)
+
+	start := time.Now().Add(-time.Hour)
+	for i := 0; i < 3; i++ {
+		if err := cache.Put(hashes[i], storage.BlobObject, blobs[i]); err != nil {
+			t.Fatal(err)
+		}
+		used := start.Add(time.Duration(i) * time.Minute)
+		if err := os.Chtimes(cachedPath(dir, hashes[i]), used, used); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Using the oldest object makes the second one the least recently used
+	if _, _, ok := cache.Get(hashes[0]); !ok {
+		t.Fatal("object 0 not cached")
+	}
+
+	if err := cache.Put(hashes[3], storage.BlobObject, blobs[3]); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []bool{true, false, false, true} {
+		if _, _, ok := cache.Get(hashes[i]); ok != want {
+			t.Errorf("object %d cached = %v, want %v", i, ok, want)
+		}
+	}
+}
+
+func TestObjectCacheSizeLimit(t *testing.T) {
+	dir := t.TempDir()
+	small := randomBlob(100, 1)
+	large := randomBlob(1000, 2)
+	cache := storage.NewObjectCache(dir, looseSize(t, large)-1)
+
+	// Objects over the limit are not cached at all
+	largeHash := storage.HashObject(storage.BlobObject, large)
+	if err := cache.Put(largeHash, storage.BlobObject, large); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := cache.Get(largeHash); ok {
+		t.Error("cached an object larger than the limit")
+	}
+
+	// Caching an object again does not count it twice
+	smallHash := storage.HashObject(storage.BlobObject, small)
+	for i := 0; i < 3; i++ {
+		if err := cache.Put(smallHash, storage.BlobObject, small); err != nil {
+			t.Fatal(err)
+		}
+	}
+	size, err := os.ReadFile(filepath.Join(dir, "size"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.TrimSpace(string(size)), fmt.Sprint(looseSize(t, small)); got != want {
+		t.Errorf("recorded size = %s, want %s", got, want)
+	}
+
+	// A record over the limit, as left by another process, makes the next
+	// Put rescan the cache, which corrects it without evicting anything
+	if err := os.WriteFile(filepath.Join(dir, "size"), []byte(fmt.Sprintln(looseSize(t, large))), 0644); err != nil {
+		t.Fatal(err)
+	}
+	other := randomBlob(100, 3)
+	otherHash := storage.HashObject(storage.BlobObject, other)
+	if err := storage.NewObjectCache(dir, looseSize(t, large)-1).Put(otherHash, storage.BlobObject, other); err != nil {
+		t.Fatal(err)
+	}
+	for _, hash := range []string{smallHash, otherHash} {
+		if _, _, ok := cache.Get(hash); !ok {
+			t.Errorf("object %s evicted", hash)
+		}
+	}
+	size, err = os.ReadFile(filepath.Join(dir, "size"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.TrimSpace(string(size)), fmt.Sprint(looseSize(t, small)+looseSize(t, other)); got != want {
+		t.Errorf("recorded size after rescan = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,179 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Signature identifies the author, committer or tagger of an object
+type Signature struct {
+	Name  string
+	Email string
+	When  time.Time
+}
+
+// String formats the signature as it appears in commit and tag headers
+func (s Signature) String() string {
+	return fmt.Sprintf("%s <%s> %d %s", s.Name, s.Email, s.When.Unix(), formatTimezone(s.When))
+}
+
+// ParseSignature parses a signature from a commit or tag header
+func ParseSignature(value string) (Signature, error) {
+	lt := strings.IndexByte(value, '<')
+	gt := strings.LastIndexByte(value, '>')
+	if lt < 0 || gt < lt {
+		return Signature{}, fmt.Errorf("invalid signature %q", value)
+	}
+
+	sig := Signature{
+		Name:  strings.TrimSuffix(value[:lt], " "),
+		Email: value[lt+1 : gt],
+	}
+
+	fields := strings.Fields(value[gt+1:])
+	if len(fields) != 2 {
+		return Signature{}, fmt.Errorf("invalid signature date in %q", value)
+	}
+	seconds, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return Signature{}, fmt.Errorf("invalid signature timestamp %q", fields[0])
+	}
+	loc, err := parseTimezone(fields[1])
+	if err != nil {
+		return Signature{}, err
+	}
+	sig.When = time.Unix(seconds, 0).In(loc)
+
+	return sig, nil
+}
+
+// formatTimezone formats the UTC offset of t as +hhmm or -hhmm. Zones created
+// by parseTimezone keep their original spelling, so "-0000" survives a round trip.
+func formatTimezone(t time.Time) string {
+	name, offset := t.Zone()
+	if _, err := parseTimezone(name); err == nil {
+		return name
+	}
+
+	sign := '+'
+	if offset < 0 {
+		sign = '-'
+		offset = -offset
+	}
+	return fmt.Sprintf("%c%02d%02d", sign, offset/3600, offset%3600/60)
+}
+
+// parseTimezone parses a +hhmm or -hhmm UTC offset into a fixed zone
+func parseTimezone(tz string) (*time.Location, error) {
+	if len(tz) != 5 || (tz[0] != '+' && tz[0] != '-') {
+		return nil, fmt.Errorf("invalid timezone %q", tz)
+	}
+	hours, err1 := strconv.Atoi(tz[1:3])
+	minutes, err2 := strconv.Atoi(tz[3:5])
+	if err1 != nil || err2 != nil {
+		return nil, fmt.Errorf("invalid timezone %q", tz)
+	}
+
+	offset := hours*3600 + minutes*60
+	if tz[0] == '-' {
+		offset = -offset
+	}
+	return time.FixedZone(tz, offset), nil
+}
+
+// ExtraHeader is a commit or tag header gitk does not interpret, such as
+// gpgsig, mergetag or encoding. Multi-line values are kept verbatim.
+type ExtraHeader struct {
+	Key   string
+	Value string
+}
+
+// Commit is a Git commit object
+type Commit struct {
+	Tree         string
+	Parents      []string
+	Author       Signature
+	Committer    Signature
+	ExtraHeaders []ExtraHeader
+	Message      string
+}
+
+// Type returns the Git object type of the commit
+func (c *Commit) Type() string {
+	return CommitObject
+}
+
+// Serialize encodes the commit in Git's commit object format
+func (c *Commit) Serialize() ([]byte, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "tree %s\n", c.Tree)
+	for _, parent := range c.Parents {
+		fmt.Fprintf(&buf, "parent %s\n", parent)
+	}
+	fmt.Fprintf(&buf, "author %s\n", c.Author)
+	fmt.Fprintf(&buf, "committer %s\n", c.Committer)
+	writeExtraHeaders(&buf, c.ExtraHeaders)
+	buf.WriteByte('\n')
+	buf.WriteString(c.Message)
+	return buf.Bytes(), nil
+}
+
+// ParseCommit parses the contents of a commit object
+func ParseCommit(data []byte) (*Commit, error) {
+	headers, message := parseHeaders(data)
+
+	commit := &Commit{Message: message}
+	for _, header := range headers {
+		var err error
+		switch header.Key {
+		case "tree":
+			commit.Tree = header.Value
+		case "parent":
+			commit.Parents = append(commit.Parents, header.Value)
+		case "author":
+			commit.Author, err = ParseSignature(header.Value)
+		case "committer":
+			commit.Committer, err = ParseSignature(header.Value)
+		default:
+			commit.ExtraHeaders = append(commit.ExtraHeaders, header)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s header: %w", header.Key, err)
+		}
+	}
+
+	if commit.Tree == "" {
+		return nil, fmt.Errorf("commit has no tree")
+	}
+
+	return commit, nil
+}
+
+// parseHeaders splits an object into its headers and message. Continuation
+// lines, which start with a space, are joined to the value of their header.
+func parseHeaders(data []byte) ([]ExtraHeader, string) {
+	head, message, _ := bytes.Cut(data, []byte("\n\n"))
+
+	var headers []ExtraHeader
+	for _, line := range strings.Split(string(head), "\n") {
+		if strings.HasPrefix(line, " ") && len(headers) > 0 {
+			headers[len(headers)-1].Value += "\n" + line[1:]
+			continue
+		}
+		key, value, _ := strings.Cut(line, " ")
+		headers = append(headers, ExtraHeader{Key: key, Value: value})
+	}
+
+	return headers, string(message)
+}
+
+// writeExtraHeaders writes headers, continuing multi-line values on lines
+// that start with a space
+func writeExtraHeaders(buf *bytes.Buffer, headers []ExtraHeader) {
+	for _, header := range headers {
+		fmt.Fprintf(buf, "%s %s\n", header.Key, strings.ReplaceAll(header.Value, "\n", "\n "))
+	}
+}
@@ -0,0 +1,257 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// Git deltas describe a target as a sequence of instructions that either
+// copy a range of the base or insert literal bytes
+
+const (
+	// deltaBlockSize is the length of the base blocks looked up in targets
+	deltaBlockSize = 16
+	// minDeltaSize is the size below which objects are stored whole, as
+	// the delta header and base offset would eat most of what a delta saves
+	minDeltaSize = 64
+	// maxDeltaCopy is the longest range one copy instruction takes, the
+	// largest that every git version reads
+	maxDeltaCopy = 0x10000
+	// maxDeltaInsert is the longest literal one insert instruction holds
+	maxDeltaInsert = 0x7f
+)
+
+var errInvalidDelta = errors.New("invalid delta")
+
+// deltaIndex locates the blocks of a base, so that deltas of several
+// targets against the same base index it only once
+type deltaIndex struct {
+	base []byte
+	// blocks maps the content of each block to its first offset in base
+	blocks map[string]int
+}
+
+// newDeltaIndex indexes the blocks of base
+func newDeltaIndex(base []byte) *deltaIndex {
+	blocks := make(map[string]int, len(base)/deltaBlockSize)
+	for offset := 0; offset+deltaBlockSize <= len(base); offset += deltaBlockSize {
+		block := string(base[offset : offset+deltaBlockSize])
+		if _, ok := blocks[block]; !ok {
+			blocks[block] = offset
+		}
+	}
+	return &deltaIndex{base: base, blocks: blocks}
+}
+
+// encodeDelta returns a delta that turns base into target
+func encodeDelta(base, target []byte) []byte {
+	return newDeltaIndex(base).encode(target)
+}
+
+// encode returns a delta that turns the indexed base into target
+func (idx *deltaIndex) encode(target []byte) []byte {
+	base, blocks := idx.base, idx.blocks
+
+	var delta bytes.Buffer
+	writeDeltaSize(&delta, len(base))
+	writeDeltaSize(&delta, len(target))
+
+	var literal []byte
+	for i := 0; i < len(target); {
+		offset, ok := -1, false
+		if i+deltaBlockSize <= len(target) {
+			offset, ok = blocks[string(target[i:i+deltaBlockSize])]
+		}
+		if !ok {
+			literal = append(literal, target[i])
+			i++
+			continue
+		}
+
+		// Grow the match forward, then backward over pending literal bytes
+		length := deltaBlockSize
+		for i+length < len(target) && offset+length < len(base) && target[i+length] == base[offset+length] {
+			length++
+		}
+		end := i + length
+		for len(literal) > 0 && offset > 0 && literal[len(literal)-1] == base[offset-1] {
+			literal = literal[:len(literal)-1]
+			offset--
+			length++
+		}
+
+		writeDeltaInsert(&delta, literal)
+		literal = literal[:0]
+		writeDeltaCopy(&delta, offset, length)
+		i = end
+	}
+	writeDeltaInsert(&delta, literal)
+
+	return delta.Bytes()
+}
+
+// writeDeltaSize writes a size of the delta header, seven bits per byte
+// starting with the lowest
+func writeDeltaSize(w *bytes.Buffer, size int) {
+	for size >= 0x80 {
+		w.WriteByte(byte(size) | 0x80)
+		size >>= 7
+	}
+	w.WriteByte(byte(size))
+}
+
+// writeDeltaInsert writes insert instructions for literal
+func writeDeltaInsert(w *bytes.Buffer, literal []byte) {
+	for len(literal) > 0 {
+		n := len(literal)
+		if n > maxDeltaInsert {
+			n = maxDeltaInsert
+		}
+		w.WriteByte(byte(n))
+		w.Write(literal[:n])
+		literal = literal[n:]
+	}
+}
+
+// writeDeltaCopy writes copy instructions for length bytes of the base at
+// offset. Only the non-zero bytes of offset and length are written, flagged
+// in the instruction byte.
+func writeDeltaCopy(w *bytes.Buffer, offset, length int) {
+	for length > 0 {
+		n := length
+		if n > maxDeltaCopy {
+			n = maxDeltaCopy
+		}
+
+		var args [7]byte
+		var count int
+		op := byte(0x80)
+		for i := 0; i < 4; i++ {
+			if b := byte(offset >> (8 * i)); b != 0 {
+				op |= 1 << i
+				args[count] = b
+				count++
+			}
+		}
+		// A size of 0x10000 is written as zero, which has no bytes at all
+		for i := 0; i < 3; i++ {
+			if b := byte(n >> (8 * i)); b != 0 && n != maxDeltaCopy {
+				op |= 1 << (4 + i)
+				args[count] = b
+				count++
+			}
+		}
+		w.WriteByte(op)
+		w.Write(args[:count])
+
+		offset += n
+		length -= n
+	}
+}
+
+// applyDelta returns the target that delta describes based on base
+func applyDelta(base, delta []byte) ([]byte, error) {
+	baseSize, n := readDeltaSize(delta)
+	if n == 0 || baseSize != uint64(len(base)) {
+		return nil, fmt.Errorf("%w: base size mismatch", errInvalidDelta)
+	}
+	delta = delta[n:]
+	targetSize, n := readDeltaSize(delta)
+	if n == 0 {
+		return nil, errInvalidDelta
+	}
+	delta = delta[n:]
+
+	// targetSize comes from the pack, so it is checked against what the
+	// instructions can produce before anything is allocated for it: each
+	// takes at least a byte, and copies at most the base or inserts at most
+	// maxDeltaInsert bytes
+	perInstruction := uint64(len(base))
+	if perInstruction < maxDeltaInsert {
+		perInstruction = maxDeltaInsert
+	}
+	if targetSize/perInstruction > uint64(len(delta)) {
+		return nil, fmt.Errorf("%w: target size out of bounds", errInvalidDelta)
+	}
+
+	// Targets are rarely larger than the base and delta together, and
+	// append grows the few that are
+	capacity := uint64(len(base) + len(delta))
+	if targetSize < capacity {
+		capacity = targetSize
+	}
+	target := make([]byte, 0, capacity)
+	for len(delta) > 0 {
+		op := delta[0]
+		delta = delta[1:]
+
+		switch {
+		case op&0x80 != 0:
+			var offset, size uint64
+			for i := 0; i < 4; i++ {
+				if op&(1<<i) != 0 {
+					if len(delta) == 0 {
+						return nil, errInvalidDelta
+					}
+					offset |= uint64(delta[0]) << (8 * i)
+					delta = delta[1:]
+				}
+			}
+			for i := 0; i < 3; i++ {
+				if op&(1<<(4+i)) != 0 {
+					if len(delta) == 0 {
+						return nil, errInvalidDelta
+					}
+					size |= uint64(delta[0]) << (8 * i)
+					delta = delta[1:]
+				}
+			}
+			if size == 0 {
+				size = maxDeltaCopy
+			}
+			if offset+size > uint64(len(base)) {
+				return nil, fmt.Errorf("%w: copy out of base bounds", errInvalidDelta)
+			}
+			if uint64(len(target))+size > targetSize {
+				return nil, fmt.Errorf("%w: target size mismatch", errInvalidDelta)
+			}
+			target = append(target, base[offset:offset+size]...)
+
+		case op != 0:
+			if int(op) > len(delta) {
+				return nil, errInvalidDelta
+			}
+			if uint64(len(target))+uint64(op) > targetSize {
+				return nil, fmt.Errorf("%w: target size mismatch", errInvalidDelta)
+			}
+			target = append(target, delta[:op]...)
+			delta = delta[op:]
+
+		default:
+			return nil, fmt.Errorf("%w: reserved instruction", errInvalidDelta)
+		}
+	}
+
+	if uint64(len(target)) != targetSize {
+		return nil, fmt.Errorf("%w: target size mismatch", errInvalidDelta)
+	}
+
+	return target, nil
+}
+
+// readDeltaSize reads a size of the delta header and returns it with the
+// number of bytes read, which is zero if data is truncated
+func readDeltaSize(data []byte) (uint64, int) {
+	var size uint64
+	for i, b := range data {
+		if i > 9 {
+			break
+		}
+		size |= uint64(b&0x7f) << (7 * i)
+		if b&0x80 == 0 {
+			return size, i + 1
+		}
+	}
+	return 0, 0
+}
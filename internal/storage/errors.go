@@ -0,0 +1,52 @@
+package storage
+
+import (
+	"fmt"
+	"io/fs"
+)
+
+// Kinds of storage failures. Use errors.Is to test for them. The kinds
+// that have an fs counterpart also match it, so a missing object or
+// reference satisfies errors.Is(err, fs.ErrNotExist) as well.
+var (
+	ErrObjectNotFound   error = &kindError{msg: "object not found", fsErr: fs.ErrNotExist}
+	ErrRefNotFound      error = &kindError{msg: "reference not found", fsErr: fs.ErrNotExist}
+	ErrAlreadyExists    error = &kindError{msg: "already exists", fsErr: fs.ErrExist}
+	ErrPermissionDenied error = &kindError{msg: "permission denied", fsErr: fs.ErrPermission}
+	ErrQuotaExceeded    error = &kindError{msg: "quota exceeded"}
+	ErrTransient        error = &kindError{msg: "transient failure"}
+)
+
+// kindError is the type of the storage error kinds
+type kindError struct {
+	msg   string
+	fsErr error
+}
+
+func (e *kindError) Error() string {
+	return e.msg
+}
+
+func (e *kindError) Is(target error) bool {
+	return e.fsErr != nil && target == e.fsErr
+}
+
+// Error is returned by backends when an operation on a key fails. Kind is
+// one of the error kinds above, or nil if the failure is of no known kind.
+type Error struct {
+	Op   string
+	Key  string
+	Kind error
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("failed to %s %s: %v", e.Op, e.Key, e.Err)
+}
+
+func (e *Error) Unwrap() []error {
+	if e.Kind == nil {
+		return []error{e.Err}
+	}
+	return []error{e.Kind, e.Err}
+}
@@ -0,0 +1,617 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+
+	gsdk "github.com/bnb-chain/greenfield-go-sdk/client"
+	"github.com/bnb-chain/greenfield-go-sdk/types"
+	gnfdsdktypes "github.com/bnb-chain/greenfield/sdk/types"
+	storagetypes "github.com/bnb-chain/greenfield/x/storage/types"
+	ctypes "github.com/cometbft/cometbft/rpc/core/types"
+	sdk "github.com/cosmos/cosmos-sdk/types"
+	"github.com/cosmos/cosmos-sdk/types/tx"
+	"google.golang.org/grpc"
+)
+
+// GreenfieldClient is the subset of the Greenfield SDK client that
+// GreenfieldBackend uses. It allows substituting an in-memory fake in tests.
+//
+// The SDK creates one object per transaction. CreateBatch instead builds
+// the create messages itself, has the storage provider approve them and
+// broadcasts them together, which takes the methods from GetDefaultAccount
+// on.
+type GreenfieldClient interface {
+	CreateObject(ctx context.Context, bucketName, objectName string, reader io.Reader, opts types.CreateObjectOptions) (string, error)
+	PutObject(ctx context.Context, bucketName, objectName string, objectSize int64, reader io.Reader, opts types.PutObjectOptions) error
+	HeadObject(ctx context.Context, bucketName, objectName string) (*types.ObjectDetail, error)
+	GetObject(ctx context.Context, bucketName, objectName string, opts types.GetObjectOptions) (io.ReadCloser, types.ObjectStat, error)
+	DeleteObject(ctx context.Context, bucketName, objectName string, opt types.DeleteObjectOption) (string, error)
+	ListObjects(ctx context.Context, bucketName string, opts types.ListObjectsOptions) (types.ListObjectsResult, error)
+
+	GetDefaultAccount() (*types.Account, error)
+	ComputeHashRoots(reader io.Reader, isSerial bool) ([][]byte, int64, storagetypes.RedundancyType, error)
+	GetCreateObjectApproval(ctx context.Context, createObjectMsg *storagetypes.MsgCreateObject) (*storagetypes.MsgCreateObject, error)
+	BroadcastTx(ctx context.Context, msgs []sdk.Msg, txOpt *gnfdsdktypes.TxOption, opts ...grpc.CallOption) (*tx.BroadcastTxResponse, error)
+	WaitForTx(ctx context.Context, hash string) (*ctypes.ResultTx, error)
+}
+
+var _ GreenfieldClient = (*gsdk.Client)(nil)
+
+// GreenfieldBackend implements Backend on top of a BNB Greenfield bucket
+type GreenfieldBackend struct {
+	client     GreenfieldClient
+	bucketName string
+}
+
+// NewGreenfieldBackend creates a new backend storing keys as objects in the given bucket
+func NewGreenfieldBackend(client GreenfieldClient, bucketName string) *GreenfieldBackend {
+	return &GreenfieldBackend{
+		client:     client,
+		bucketName: bucketName,
+	}
+}
+
+// pendingSuffix is appended to a key to name the journal object that holds
+// its new data while Put replaces it
+const pendingSuffix = ".pending"
+
+// listPageSize is the number of objects requested per ListObjects call, the
+// most storage providers return
+const listPageSize = 1000
+
+// uploadConcurrency is the number of requests CreateBatch sends to the
+// storage provider in parallel
+const uploadConcurrency = 8
+
+var errObjectNotSealed = errors.New("object has been created but not sealed")
+
+// Put stores data under key. Greenfield objects cannot be overwritten, so
+// an existing object is deleted and created again. The new data is first
+// journaled in a separate object that readers fall back to while the object
+// is missing, so a crash at any point leaves either the old or the new data
+// readable. Callers must serialize concurrent Puts to the same key, as
+// CompareAndSetReference does for references.
+func (b *GreenfieldBackend) Put(ctx context.Context, key string, data []byte) error {
+	return b.put(ctx, key, bytes.NewReader(data), int64(len(data)))
+}
+
+// put stores the size bytes of payload under key like Put
+func (b *GreenfieldBackend) put(ctx context.Context, key string, payload io.ReadSeeker, size int64) error {
+	err := b.create(ctx, key, payload, size)
+	if !errors.Is(err, ErrAlreadyExists) {
+		return err
+	}
+	return b.replace(ctx, key, payload, size)
+}
+
+// replace swaps the existing object named key for one holding payload
+func (b *GreenfieldBackend) replace(ctx context.Context, key string, payload io.ReadSeeker, size int64) error {
+	journal := key + pendingSuffix
+
+	err := b.create(ctx, journal, payload, size)
+	if errors.Is(err, ErrAlreadyExists) {
+		// An earlier replacement was interrupted, settle it first
+		if err := b.recover(ctx, key); err != nil {
+			return err
+		}
+		err = b.create(ctx, journal, payload, size)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to journal new data: %w", err)
+	}
+
+	if err := b.deleteObject(ctx, key); err != nil && !errors.Is(err, ErrObjectNotFound) {
+		return err
+	}
+	if err := b.create(ctx, key, payload, size); err != nil {
+		return err
+	}
+
+	return b.deleteObject(ctx, journal)
+}
+
+// recover settles an interrupted replacement of key. The journaled data
+// only takes effect if the old object had already been deleted.
+func (b *GreenfieldBackend) recover(ctx context.Context, key string) error {
+	journal := key + pendingSuffix
+
+	_, err := b.headObject(ctx, key)
+	switch {
+	case err == nil:
+		// The old object is still in place, abandon the replacement
+	case errors.Is(err, ErrObjectNotFound):
+		data, err := b.getObject(ctx, journal)
+		if err != nil {
+			return err
+		}
+		// Clear out an object whose upload was interrupted
+		if err := b.deleteObject(ctx, key); err != nil && !errors.Is(err, ErrObjectNotFound) {
+			return err
+		}
+		if err := b.Create(ctx, key, data); err != nil {
+			return err
+		}
+	default:
+		return err
+	}
+
+	return b.deleteObject(ctx, journal)
+}
+
+// PutFrom stores the data read from r under key like Put. Greenfield reads
+// a payload twice, to compute its checksums for the creating transaction
+// and to upload it, so r is passed on as is if it can seek and read at
+// offsets, like files do, and is spooled to a temporary file otherwise.
+func (b *GreenfieldBackend) PutFrom(ctx context.Context, key string, r io.Reader) error {
+	payload, size, cleanup, err := rereadable(r)
+	if err != nil {
+		return fmt.Errorf("failed to read data for %s: %w", key, err)
+	}
+	defer cleanup()
+
+	return b.put(ctx, key, payload, size)
+}
+
+// rereadable returns the rest of r as a reader that can be rewound, along
+// with its size and a function releasing it
+func rereadable(r io.Reader) (io.ReadSeeker, int64, func(), error) {
+	if ra, ok := r.(interface {
+		io.ReaderAt
+		io.Seeker
+	}); ok {
+		start, err := ra.Seek(0, io.SeekCurrent)
+		if err == nil {
+			end, err := ra.Seek(0, io.SeekEnd)
+			if err != nil {
+				return nil, 0, nil, err
+			}
+			return io.NewSectionReader(ra, start, end-start), end - start, func() {}, nil
+		}
+	}
+
+	f, err := os.CreateTemp("", "gitk-upload-*")
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	cleanup := func() {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	size, err := io.Copy(f, r)
+	if err != nil {
+		cleanup()
+		return nil, 0, nil, err
+	}
+
+	return f, size, cleanup, nil
+}
+
+// Create creates an object named key and uploads data to it. Object
+// creation is a chain transaction, which fails if the name is taken.
+func (b *GreenfieldBackend) Create(ctx context.Context, key string, data []byte) error {
+	return b.create(ctx, key, bytes.NewReader(data), int64(len(data)))
+}
+
+// create creates an object named key and uploads the size bytes of payload
+// to it. The payload is read twice, once to compute its checksums for the
+// creation and once to upload it.
+func (b *GreenfieldBackend) create(ctx context.Context, key string, payload io.ReadSeeker, size int64) error {
+	if _, err := payload.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to create object %s: %w", key, err)
+	}
+	txHash, err := b.client.CreateObject(
+		ctx,
+		b.bucketName,
+		key,
+		payload,
+		types.CreateObjectOptions{},
+	)
+	if err != nil {
+		return greenfieldError("create object", key, err)
+	}
+
+	return b.upload(ctx, key, txHash, payload, size)
+}
+
+// upload uploads the payload of the object named key, which the
+// transaction txHash created, and so seals it
+func (b *GreenfieldBackend) upload(ctx context.Context, key, txHash string, payload io.ReadSeeker, size int64) error {
+	// Empty objects are sealed on creation
+	if size == 0 {
+		return nil
+	}
+
+	if _, err := payload.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to upload object %s: %w", key, err)
+	}
+	if err := b.client.PutObject(
+		ctx,
+		b.bucketName,
+		key,
+		size,
+		payload,
+		types.PutObjectOptions{TxnHash: txHash},
+	); err != nil {
+		return greenfieldError("upload object", key, err)
+	}
+
+	return nil
+}
+
+// CreateBatch creates the objects for all entries in one transaction, which
+// saves fees and confirmation time over creating them one by one, and then
+// uploads their payloads in parallel
+func (b *GreenfieldBackend) CreateBatch(ctx context.Context, entries []KeyData) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	batch := fmt.Sprintf("%s and %d more", entries[0].Key, len(entries)-1)
+
+	account, err := b.client.GetDefaultAccount()
+	if err != nil {
+		return greenfieldError("create objects", batch, err)
+	}
+
+	msgs := make([]sdk.Msg, len(entries))
+	err = parallel(ctx, len(entries), func(ctx context.Context, i int) error {
+		msg, err := b.createObjectMsg(ctx, account.GetAddress(), entries[i])
+		if err != nil {
+			return greenfieldError("create object", entries[i].Key, err)
+		}
+		msgs[i] = msg
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	txHash, err := b.broadcast(ctx, msgs)
+	if err != nil {
+		return greenfieldError("create objects", batch, err)
+	}
+
+	return parallel(ctx, len(entries), func(ctx context.Context, i int) error {
+		entry := entries[i]
+		return b.upload(ctx, entry.Key, txHash, bytes.NewReader(entry.Data), int64(len(entry.Data)))
+	})
+}
+
+// createObjectMsg builds the message that creates an object for entry, and
+// has the primary storage provider of the bucket approve it, as
+// CreateObject does for a single object
+func (b *GreenfieldBackend) createObjectMsg(ctx context.Context, creator sdk.AccAddress, entry KeyData) (*storagetypes.MsgCreateObject, error) {
+	checksums, size, redundancy, err := b.client.ComputeHashRoots(bytes.NewReader(entry.Data), false)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := storagetypes.NewMsgCreateObject(creator, b.bucketName, entry.Key, uint64(size),
+		storagetypes.VISIBILITY_TYPE_INHERIT, checksums, types.ContentDefault, redundancy, math.MaxUint64, nil)
+	if err := msg.ValidateBasic(); err != nil {
+		return nil, err
+	}
+
+	return b.client.GetCreateObjectApproval(ctx, msg)
+}
+
+// broadcast sends msgs in a single transaction and returns its hash once it
+// has been committed
+func (b *GreenfieldBackend) broadcast(ctx context.Context, msgs []sdk.Msg) (string, error) {
+	mode := tx.BroadcastMode_BROADCAST_MODE_SYNC
+	resp, err := b.client.BroadcastTx(ctx, msgs, &gnfdsdktypes.TxOption{Mode: &mode})
+	if err != nil {
+		// A transaction rejected by the node only tells why in its log
+		if resp != nil && resp.TxResponse != nil {
+			return "", fmt.Errorf("%w: %s", err, resp.TxResponse.RawLog)
+		}
+		return "", err
+	}
+
+	txHash := resp.TxResponse.TxHash
+	return txHash, b.waitForTx(ctx, txHash)
+}
+
+// waitForTx waits until the transaction txHash has been committed, and
+// fails if it was not executed successfully
+func (b *GreenfieldBackend) waitForTx(ctx context.Context, txHash string) error {
+	result, err := b.client.WaitForTx(ctx, txHash)
+	if err != nil {
+		return err
+	}
+	if result.TxResult.Code != 0 {
+		return fmt.Errorf("transaction %s failed: %s", txHash, result.TxResult.Log)
+	}
+
+	return nil
+}
+
+// parallel calls fn with 0 to n-1, up to uploadConcurrency calls at a time.
+// Once a call fails, the context of the others is canceled and no more calls
+// are started. It returns the first failure.
+func parallel(ctx context.Context, n int, fn func(ctx context.Context, i int) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	slots := make(chan struct{}, uploadConcurrency)
+	for i := 0; i < n; i++ {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			if err := fn(ctx, i); err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+					cancel()
+				}
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
+
+// Get downloads the object named key, or the data journaled for it by an
+// unfinished Put
+func (b *GreenfieldBackend) Get(ctx context.Context, key string) ([]byte, error) {
+	data, err := b.getObject(ctx, key)
+	if errors.Is(err, ErrObjectNotFound) {
+		if data, err := b.getObject(ctx, key+pendingSuffix); err == nil {
+			return data, nil
+		}
+	}
+	return data, err
+}
+
+// Open returns a reader of the object named key, or of the data journaled
+// for it by an unfinished Put, that streams the payload from the storage
+// provider
+func (b *GreenfieldBackend) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	body, err := b.openObject(ctx, key, types.GetObjectOptions{})
+	if errors.Is(err, ErrObjectNotFound) {
+		if body, err := b.openObject(ctx, key+pendingSuffix, types.GetObjectOptions{}); err == nil {
+			return body, nil
+		}
+	}
+	return body, err
+}
+
+// GetRange downloads length bytes of the object named key, starting at
+// offset, with an HTTP range request
+func (b *GreenfieldBackend) GetRange(ctx context.Context, key string, offset, length int64) ([]byte, error) {
+	if length <= 0 {
+		return nil, nil
+	}
+
+	opts := types.GetObjectOptions{Range: fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)}
+	data, err := b.getObjectWith(ctx, key, opts)
+	if errors.Is(err, ErrObjectNotFound) {
+		if data, err := b.getObjectWith(ctx, key+pendingSuffix, opts); err == nil {
+			return data, nil
+		}
+	}
+	return data, err
+}
+
+func (b *GreenfieldBackend) getObject(ctx context.Context, key string) ([]byte, error) {
+	return b.getObjectWith(ctx, key, types.GetObjectOptions{})
+}
+
+func (b *GreenfieldBackend) getObjectWith(ctx context.Context, key string, opts types.GetObjectOptions) ([]byte, error) {
+	body, err := b.openObject(ctx, key, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, greenfieldError("get object", key, err)
+	}
+
+	return data, nil
+}
+
+func (b *GreenfieldBackend) openObject(ctx context.Context, key string, opts types.GetObjectOptions) (io.ReadCloser, error) {
+	body, _, err := b.client.GetObject(
+		ctx,
+		b.bucketName,
+		key,
+		opts,
+	)
+	if err != nil {
+		return nil, greenfieldError("get object", key, err)
+	}
+
+	return body, nil
+}
+
+// Head returns the metadata of the object named key, or of the data
+// journaled for it by an unfinished Put
+func (b *GreenfieldBackend) Head(ctx context.Context, key string) (*KeyInfo, error) {
+	info, err := b.headObject(ctx, key)
+	if errors.Is(err, ErrObjectNotFound) {
+		if info, err := b.headObject(ctx, key+pendingSuffix); err == nil {
+			return &KeyInfo{Key: key, Size: info.Size}, nil
+		}
+	}
+	return info, err
+}
+
+func (b *GreenfieldBackend) headObject(ctx context.Context, key string) (*KeyInfo, error) {
+	detail, err := b.client.HeadObject(
+		ctx,
+		b.bucketName,
+		key,
+	)
+	if err != nil {
+		return nil, greenfieldError("head object", key, err)
+	}
+
+	// An object whose upload never completed cannot be read, so it does not
+	// count as existing
+	if detail.ObjectInfo.ObjectStatus != storagetypes.OBJECT_STATUS_SEALED {
+		return nil, &Error{Op: "head object", Key: key, Kind: ErrObjectNotFound, Err: errObjectNotSealed}
+	}
+
+	return &KeyInfo{
+		Key:  key,
+		Size: int64(detail.ObjectInfo.PayloadSize),
+	}, nil
+}
+
+// Delete removes the object named key along with any data journaled for it
+func (b *GreenfieldBackend) Delete(ctx context.Context, key string) error {
+	err := b.deleteObject(ctx, key)
+	journalErr := b.deleteObject(ctx, key+pendingSuffix)
+	if errors.Is(err, ErrObjectNotFound) && journalErr == nil {
+		return nil
+	}
+	return err
+}
+
+// deleteObject deletes the object named key and waits for the deletion to
+// be committed, so that the name can be taken again right away
+func (b *GreenfieldBackend) deleteObject(ctx context.Context, key string) error {
+	txHash, err := b.client.DeleteObject(
+		ctx,
+		b.bucketName,
+		key,
+		types.DeleteObjectOption{},
+	)
+	if err == nil {
+		err = b.waitForTx(ctx, txHash)
+	}
+	if err != nil {
+		return greenfieldError("delete object", key, err)
+	}
+
+	return nil
+}
+
+// Walk calls fn for the name of every object in the bucket that begins with
+// prefix, in lexical order, fetching one page of the listing at a time.
+// Journal objects are reported under the key they hold data for, unless
+// that key exists itself.
+func (b *GreenfieldBackend) Walk(ctx context.Context, prefix string, fn func(key string) error) error {
+	opts := types.ListObjectsOptions{
+		Prefix:  prefix,
+		MaxKeys: listPageSize,
+	}
+
+	for {
+		page, err := b.client.ListObjects(ctx, b.bucketName, opts)
+		if err != nil {
+			return greenfieldError("list objects", prefix, err)
+		}
+
+		for _, obj := range page.Objects {
+			key := obj.ObjectInfo.ObjectName
+			if base, ok := strings.CutSuffix(key, pendingSuffix); ok {
+				// The key itself, if present, sorts before its journal and
+				// has been reported already
+				_, err := b.headObject(ctx, base)
+				if err == nil {
+					continue
+				}
+				if !errors.Is(err, ErrObjectNotFound) {
+					return err
+				}
+				key = base
+			}
+
+			if err := fn(key); err != nil {
+				return err
+			}
+		}
+
+		if !page.IsTruncated {
+			return nil
+		}
+		opts.ContinuationToken = page.NextContinuationToken
+	}
+}
+
+// greenfieldError describes the failure of the operation op on key
+func greenfieldError(op, key string, err error) error {
+	return &Error{Op: op, Key: key, Kind: classifyGreenfield(err), Err: err}
+}
+
+// classifyGreenfield determines the kind of an error returned by the
+// storage provider or the chain
+func classifyGreenfield(err error) error {
+	var resp types.ErrResponse
+	if errors.As(err, &resp) {
+		switch {
+		case resp.Code == "NoSuchObject":
+			return ErrObjectNotFound
+		case resp.Code == "AccessDenied", resp.StatusCode == http.StatusForbidden:
+			return ErrPermissionDenied
+		case resp.StatusCode == http.StatusTooManyRequests,
+			resp.StatusCode == http.StatusRequestTimeout,
+			resp.StatusCode >= http.StatusInternalServerError:
+			return ErrTransient
+		case resp.StatusCode == http.StatusNotFound && resp.Code != "NoSuchBucket":
+			return ErrObjectNotFound
+		}
+	}
+
+	// Chain queries and transactions fail with plain messages
+	msg := strings.ToLower(err.Error())
+	switch {
+	case strings.Contains(msg, "no such object"):
+		return ErrObjectNotFound
+	case strings.Contains(msg, "already exists"):
+		return ErrAlreadyExists
+	case strings.Contains(msg, "quota"), strings.Contains(msg, "insufficient"):
+		return ErrQuotaExceeded
+	case isTransientNetworkError(err):
+		return ErrTransient
+	}
+
+	return nil
+}
+
+// isTransientNetworkError reports whether err is a network failure that
+// may not happen again, such as a timeout or a dropped connection
+func isTransientNetworkError(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	return errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE)
+}
@@ -0,0 +1,255 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/bnb-chain/greenfield-go-sdk/types"
+	"github.com/mindkit-xyz/mindkit-gitk/internal/storage"
+	"github.com/mindkit-xyz/mindkit-gitk/internal/storage/greenfieldtest"
+)
+
+// mustGet fails the test unless key holds want
+func mustGet(t *testing.T, backend storage.Backend, key, want string) {
+	t.Helper()
+
+	data, err := backend.Get(context.Background(), key)
+	if err != nil || string(data) != want {
+		t.Fatalf("Get(%s) = %q, %v; want %q", key, data, err, want)
+	}
+}
+
+func TestGreenfieldPutReplacesObject(t *testing.T) {
+	ctx := context.Background()
+	client, backend := greenfieldtest.NewBackend()
+
+	for _, data := range []string{"old", "new"} {
+		if err := backend.Put(ctx, "refs/heads/main", []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mustGet(t, backend, "refs/heads/main", "new")
+	if objects := client.Objects(greenfieldtest.Bucket); !reflect.DeepEqual(objects, []string{"refs/heads/main"}) {
+		t.Fatalf("bucket holds %v, want only the replaced object", objects)
+	}
+}
+
+func TestGreenfieldReadsJournalWhileObjectIsMissing(t *testing.T) {
+	ctx := context.Background()
+	client, backend := greenfieldtest.NewBackend()
+	if err := backend.Put(ctx, "refs/heads/main", []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The replacement stops after deleting the old object, before creating
+	// the new one: the name is taken, the journal created, the object deleted
+	client.FailNext("CreateObject", nil, nil, greenfieldtest.ErrServiceUnavailable)
+	if err := backend.Put(ctx, "refs/heads/main", []byte("new")); err == nil {
+		t.Fatal("interrupted Put succeeded")
+	}
+	if objects := client.Objects(greenfieldtest.Bucket); !reflect.DeepEqual(objects, []string{"refs/heads/main.pending"}) {
+		t.Fatalf("bucket holds %v, want only the journal", objects)
+	}
+
+	mustGet(t, backend, "refs/heads/main", "new")
+	if info, err := backend.Head(ctx, "refs/heads/main"); err != nil || info.Key != "refs/heads/main" || info.Size != 3 {
+		t.Errorf("Head = %+v, %v; want the size of the journaled data", info, err)
+	}
+	if data, err := backend.GetRange(ctx, "refs/heads/main", 1, 2); err != nil || string(data) != "ew" {
+		t.Errorf("GetRange = %q, %v; want %q", data, err, "ew")
+	}
+	body, err := backend.Open(ctx, "refs/heads/main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(body)
+	body.Close()
+	if err != nil || string(data) != "new" {
+		t.Errorf("Open read %q, %v; want %q", data, err, "new")
+	}
+
+	var keys []string
+	if err := backend.Walk(ctx, "refs/", func(key string) error {
+		keys = append(keys, key)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, []string{"refs/heads/main"}) {
+		t.Errorf("Walk = %v, want the journaled key under its own name", keys)
+	}
+}
+
+func TestGreenfieldPutRecoversInterruptedUpload(t *testing.T) {
+	ctx := context.Background()
+	client, backend := greenfieldtest.NewBackend()
+	if err := backend.Put(ctx, "refs/heads/main", []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The new object is created but its upload fails, leaving it unsealed
+	client.FailNext("PutObject", nil, greenfieldtest.ErrServiceUnavailable)
+	if err := backend.Put(ctx, "refs/heads/main", []byte("new")); err == nil {
+		t.Fatal("interrupted Put succeeded")
+	}
+	mustGet(t, backend, "refs/heads/main", "new")
+
+	// The next Put settles the interrupted one before replacing its data
+	if err := backend.Put(ctx, "refs/heads/main", []byte("newer")); err != nil {
+		t.Fatal(err)
+	}
+	mustGet(t, backend, "refs/heads/main", "newer")
+	if objects := client.Objects(greenfieldtest.Bucket); !reflect.DeepEqual(objects, []string{"refs/heads/main"}) {
+		t.Fatalf("bucket holds %v, want only the replaced object", objects)
+	}
+}
+
+func TestGreenfieldPutAbandonsJournalOfUndeletedObject(t *testing.T) {
+	ctx := context.Background()
+	client, backend := greenfieldtest.NewBackend()
+	if err := backend.Put(ctx, "refs/heads/main", []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The replacement stops before deleting the old object, which stays in
+	// effect
+	client.FailNext("DeleteObject", greenfieldtest.ErrServiceUnavailable)
+	if err := backend.Put(ctx, "refs/heads/main", []byte("new")); err == nil {
+		t.Fatal("interrupted Put succeeded")
+	}
+	mustGet(t, backend, "refs/heads/main", "old")
+
+	if err := backend.Put(ctx, "refs/heads/main", []byte("newer")); err != nil {
+		t.Fatal(err)
+	}
+	mustGet(t, backend, "refs/heads/main", "newer")
+	if objects := client.Objects(greenfieldtest.Bucket); !reflect.DeepEqual(objects, []string{"refs/heads/main"}) {
+		t.Fatalf("bucket holds %v, want only the replaced object", objects)
+	}
+}
+
+func TestGreenfieldDeleteRemovesJournal(t *testing.T) {
+	ctx := context.Background()
+	client, backend := greenfieldtest.NewBackend()
+	if err := backend.Put(ctx, "refs/heads/main", []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	client.FailNext("CreateObject", nil, nil, greenfieldtest.ErrServiceUnavailable)
+	if err := backend.Put(ctx, "refs/heads/main", []byte("new")); err == nil {
+		t.Fatal("interrupted Put succeeded")
+	}
+
+	if err := backend.Delete(ctx, "refs/heads/main"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := backend.Get(ctx, "refs/heads/main"); !errors.Is(err, storage.ErrObjectNotFound) {
+		t.Fatalf("Get after Delete = %v, want ErrObjectNotFound", err)
+	}
+	if objects := client.Objects(greenfieldtest.Bucket); len(objects) != 0 {
+		t.Fatalf("bucket holds %v after Delete", objects)
+	}
+}
+
+func TestGreenfieldWalkFollowsPages(t *testing.T) {
+	ctx := context.Background()
+	client, backend := greenfieldtest.NewBackend()
+
+	// More keys than fit in two pages, with journals around the first page
+	// boundary
+	var entries []storage.KeyData
+	var want []string
+	for i := 0; i < 2500; i++ {
+		key := fmt.Sprintf("objects/%04d", i)
+		want = append(want, key)
+		if i == 999 || i == 1000 {
+			key += ".pending"
+		}
+		entries = append(entries, storage.KeyData{Key: key, Data: []byte(key)})
+	}
+	if err := backend.CreateBatch(ctx, entries); err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	if err := backend.Walk(ctx, "objects/", func(key string) error {
+		keys = append(keys, key)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("Walk delivered %d keys, want %d in order", len(keys), len(want))
+	}
+	if got := client.Calls("ListObjects"); got != 3 {
+		t.Errorf("ListObjects called %d times, want 3", got)
+	}
+}
+
+// timeoutError is a network error that timed out
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+var _ net.Error = timeoutError{}
+
+func TestGreenfieldErrorKinds(t *testing.T) {
+	kinds := []error{
+		storage.ErrObjectNotFound,
+		storage.ErrAlreadyExists,
+		storage.ErrPermissionDenied,
+		storage.ErrQuotaExceeded,
+		storage.ErrTransient,
+	}
+	for _, tt := range []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"no such object", types.ErrResponse{StatusCode: http.StatusNotFound, Code: "NoSuchObject"}, storage.ErrObjectNotFound},
+		{"not found", types.ErrResponse{StatusCode: http.StatusNotFound, Code: "NotFound"}, storage.ErrObjectNotFound},
+		{"no such bucket", types.ErrResponse{StatusCode: http.StatusNotFound, Code: "NoSuchBucket"}, nil},
+		{"access denied", types.ErrResponse{StatusCode: http.StatusForbidden, Code: "AccessDenied"}, storage.ErrPermissionDenied},
+		{"forbidden", types.ErrResponse{StatusCode: http.StatusForbidden, Code: "InvalidSignature"}, storage.ErrPermissionDenied},
+		{"too many requests", types.ErrResponse{StatusCode: http.StatusTooManyRequests, Code: "SlowDown"}, storage.ErrTransient},
+		{"request timeout", types.ErrResponse{StatusCode: http.StatusRequestTimeout, Code: "RequestTimeout"}, storage.ErrTransient},
+		{"service unavailable", greenfieldtest.ErrServiceUnavailable, storage.ErrTransient},
+		{"bad request", types.ErrResponse{StatusCode: http.StatusBadRequest, Code: "InvalidArgument"}, nil},
+		{"chain no such object", errors.New("rpc error: No such object"), storage.ErrObjectNotFound},
+		{"chain already exists", errors.New("rpc error: Object already exists"), storage.ErrAlreadyExists},
+		{"insufficient balance", errors.New("insufficient funds"), storage.ErrQuotaExceeded},
+		{"quota", errors.New("read quota exhausted"), storage.ErrQuotaExceeded},
+		{"network timeout", fmt.Errorf("dial: %w", timeoutError{}), storage.ErrTransient},
+		{"unknown", errors.New("something else"), nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			client, backend := greenfieldtest.NewBackend()
+			if err := backend.Put(ctx, "key", []byte("data")); err != nil {
+				t.Fatal(err)
+			}
+
+			client.FailNext("GetObject", tt.err)
+			_, err := backend.Get(ctx, "key")
+			if err == nil {
+				t.Fatal("Get succeeded")
+			}
+			if !errors.Is(err, tt.err) {
+				t.Errorf("Get = %v, want it to wrap %v", err, tt.err)
+			}
+			for _, kind := range kinds {
+				if got := errors.Is(err, kind); got != (kind == tt.want) {
+					t.Errorf("errors.Is(%v, %v) = %v", err, kind, got)
+				}
+			}
+		})
+	}
+}
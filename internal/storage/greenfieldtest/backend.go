@@ -0,0 +1,15 @@
+package greenfieldtest
+
+import (
+	"github.com/mindkit-xyz/mindkit-gitk/internal/storage"
+)
+
+// Bucket is the name of the bucket NewBackend creates
+const Bucket = "gitk-test"
+
+// NewBackend creates a fake client holding the empty bucket Bucket and a
+// GreenfieldBackend that stores its keys there
+func NewBackend() (*Client, *storage.GreenfieldBackend) {
+	client := NewClient(Bucket)
+	return client, storage.NewGreenfieldBackend(client, Bucket)
+}
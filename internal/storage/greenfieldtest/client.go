@@ -0,0 +1,569 @@
+// Package greenfieldtest provides an in-memory stand-in for the BNB Greenfield
+// client so that storage and commands can be exercised without a live chain.
+package greenfieldtest
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/bnb-chain/greenfield-go-sdk/types"
+	gnfdsdktypes "github.com/bnb-chain/greenfield/sdk/types"
+	"github.com/bnb-chain/greenfield/types/common"
+	storagetypes "github.com/bnb-chain/greenfield/x/storage/types"
+	abci "github.com/cometbft/cometbft/abci/types"
+	ctypes "github.com/cometbft/cometbft/rpc/core/types"
+	sdk "github.com/cosmos/cosmos-sdk/types"
+	"github.com/cosmos/cosmos-sdk/types/tx"
+	"google.golang.org/grpc"
+	"github.com/mindkit-xyz/mindkit-gitk/internal/storage"
+)
+
+// Default and maximum page sizes of ListObjects, matching the storage providers
+const (
+	defaultMaxKeys = 50
+	maxMaxKeys     = 1000
+)
+
+// ErrObjectAlreadyExists is returned when an object name is already taken,
+// mirroring the error of the Greenfield storage module
+var ErrObjectAlreadyExists = errors.New("Object already exists")
+
+// ErrServiceUnavailable is the response of an overloaded storage provider,
+// for use with FailNext
+var ErrServiceUnavailable = types.ErrResponse{
+	StatusCode: http.StatusServiceUnavailable,
+	Code:       "ServiceUnavailable",
+	Message:    "The service is temporarily unavailable.",
+}
+
+// errNoSuchObject is the error of chain queries and transactions on an
+// object that does not exist
+var errNoSuchObject = errors.New("No such object")
+
+// testPrivateKey is the key of the account the fake client acts for
+const testPrivateKey = "4e4b0f2d4e8a3d1b5a3b5e1b0f8b9c0d7a6b5c4d3e2f1a0b9c8d7e6f5a4b3c2d"
+
+var _ storage.GreenfieldClient = (*Client)(nil)
+
+// Client is an in-memory implementation of storage.GreenfieldClient.
+// Objects go through the same lifecycle as on chain: a transaction creates
+// the object, declaring the size and checksum of its payload, and the object
+// only becomes readable once PutObject has sealed it with that payload.
+type Client struct {
+	mu       sync.Mutex
+	account  *types.Account
+	buckets  map[string]map[string]*object
+	txs      map[string]bool
+	txCount  int
+	failures map[string][]error
+	calls    map[string]int
+}
+
+type object struct {
+	bucketName string
+	objectName string
+	// txHash names the transaction that created the object
+	txHash   string
+	size     int64
+	checksum []byte
+	data     []byte
+	sealed   bool
+}
+
+// NewClient creates a new fake client with the given (empty) buckets
+func NewClient(bucketNames ...string) *Client {
+	account, err := types.NewAccountFromPrivateKey("greenfieldtest", testPrivateKey)
+	if err != nil {
+		panic(err)
+	}
+
+	c := &Client{
+		account:  account,
+		buckets:  make(map[string]map[string]*object),
+		txs:      make(map[string]bool),
+		failures: make(map[string][]error),
+		calls:    make(map[string]int),
+	}
+	for _, name := range bucketNames {
+		c.buckets[name] = make(map[string]*object)
+	}
+	return c
+}
+
+// CreateObject creates an object for the payload read from reader in a
+// transaction of its own, and returns the transaction hash
+func (c *Client) CreateObject(ctx context.Context, bucketName, objectName string, reader io.Reader, opts types.CreateObjectOptions) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	checksums, size, _, err := c.ComputeHashRoots(reader, false)
+	if err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.injectedFailure("CreateObject"); err != nil {
+		return "", err
+	}
+
+	msg := &storagetypes.MsgCreateObject{
+		BucketName:      bucketName,
+		ObjectName:      objectName,
+		PayloadSize:     uint64(size),
+		ExpectChecksums: checksums,
+	}
+	return c.commit([]*storagetypes.MsgCreateObject{msg})
+}
+
+// PutObject uploads the payload of an object created before and seals it.
+// The payload must match the size and checksum declared on creation.
+func (c *Client) PutObject(ctx context.Context, bucketName, objectName string, objectSize int64, reader io.Reader, opts types.PutObjectOptions) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if objectSize <= 0 {
+		return errors.New("object size should be more than 0")
+	}
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.injectedFailure("PutObject"); err != nil {
+		return err
+	}
+
+	obj, err := c.object(bucketName, objectName)
+	if err != nil {
+		return err
+	}
+	if opts.TxnHash != "" && opts.TxnHash != obj.txHash {
+		return fmt.Errorf("object %s was not created by transaction %s", objectName, opts.TxnHash)
+	}
+	if obj.sealed {
+		return types.ErrResponse{
+			StatusCode: http.StatusBadRequest,
+			Code:       "InvalidObjectState",
+			Message:    "The object has been sealed already.",
+		}
+	}
+	checksum := sha256.Sum256(data)
+	if int64(len(data)) != objectSize || objectSize != obj.size || !bytes.Equal(checksum[:], obj.checksum) {
+		return types.ErrResponse{
+			StatusCode: http.StatusBadRequest,
+			Code:       "InvalidPayload",
+			Message:    "The payload does not match the object created.",
+		}
+	}
+
+	obj.data = data
+	obj.sealed = true
+
+	return nil
+}
+
+// HeadObject returns the metadata of an object, sealed or not
+func (c *Client) HeadObject(ctx context.Context, bucketName, objectName string) (*types.ObjectDetail, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.injectedFailure("HeadObject"); err != nil {
+		return nil, err
+	}
+
+	bucket, err := c.bucket(bucketName)
+	if err != nil {
+		return nil, err
+	}
+	obj, ok := bucket[objectName]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s/%s", errNoSuchObject, bucketName, objectName)
+	}
+
+	status := storagetypes.OBJECT_STATUS_CREATED
+	if obj.sealed {
+		status = storagetypes.OBJECT_STATUS_SEALED
+	}
+
+	return &types.ObjectDetail{
+		ObjectInfo: &storagetypes.ObjectInfo{
+			BucketName:   bucketName,
+			ObjectName:   objectName,
+			PayloadSize:  uint64(obj.size),
+			ObjectStatus: status,
+		},
+	}, nil
+}
+
+// GetObject returns a reader of the payload of a sealed object, or of the
+// part of it that opts.Range selects in the form "bytes=<first>-<last>"
+func (c *Client) GetObject(ctx context.Context, bucketName, objectName string, opts types.GetObjectOptions) (io.ReadCloser, types.ObjectStat, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, types.ObjectStat{}, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.injectedFailure("GetObject"); err != nil {
+		return nil, types.ObjectStat{}, err
+	}
+
+	obj, err := c.object(bucketName, objectName)
+	if err != nil {
+		return nil, types.ObjectStat{}, err
+	}
+	if !obj.sealed {
+		return nil, types.ObjectStat{}, types.ErrResponse{
+			StatusCode: http.StatusNotFound,
+			Code:       "NoSuchObject",
+			Message:    "The object has not been sealed yet.",
+		}
+	}
+
+	data := obj.data
+	if opts.Range != "" {
+		var first, last int
+		if _, err := fmt.Sscanf(opts.Range, "bytes=%d-%d", &first, &last); err != nil || first > last {
+			return nil, types.ObjectStat{}, types.ErrResponse{
+				StatusCode: http.StatusBadRequest,
+				Code:       "InvalidRange",
+				Message:    fmt.Sprintf("Invalid range %q.", opts.Range),
+			}
+		}
+		if first >= len(data) {
+			return nil, types.ObjectStat{}, types.ErrResponse{
+				StatusCode: http.StatusRequestedRangeNotSatisfiable,
+				Code:       "InvalidRange",
+				Message:    "The requested range is not satisfiable.",
+			}
+		}
+		if last >= len(data) {
+			last = len(data) - 1
+		}
+		data = data[first : last+1]
+	}
+
+	// Sealed payloads are never modified, so the reader can share them
+	stat := types.ObjectStat{ObjectName: objectName, ContentType: types.ContentDefault, Size: int64(len(data))}
+	return io.NopCloser(bytes.NewReader(data)), stat, nil
+}
+
+// DeleteObject removes an object in a transaction and returns its hash
+func (c *Client) DeleteObject(ctx context.Context, bucketName, objectName string, opt types.DeleteObjectOption) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.injectedFailure("DeleteObject"); err != nil {
+		return "", err
+	}
+
+	bucket, err := c.bucket(bucketName)
+	if err != nil {
+		return "", err
+	}
+	if _, ok := bucket[objectName]; !ok {
+		return "", fmt.Errorf("%w: %s/%s", errNoSuchObject, bucketName, objectName)
+	}
+	delete(bucket, objectName)
+
+	return c.newTx(), nil
+}
+
+// ListObjects returns one page of the objects whose names begin with
+// opts.Prefix, in lexical order
+func (c *Client) ListObjects(ctx context.Context, bucketName string, opts types.ListObjectsOptions) (types.ListObjectsResult, error) {
+	if err := ctx.Err(); err != nil {
+		return types.ListObjectsResult{}, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.injectedFailure("ListObjects"); err != nil {
+		return types.ListObjectsResult{}, err
+	}
+
+	bucket, err := c.bucket(bucketName)
+	if err != nil {
+		return types.ListObjectsResult{}, err
+	}
+
+	startAfter := opts.StartAfter
+	if opts.ContinuationToken != "" {
+		token, err := base64.StdEncoding.DecodeString(opts.ContinuationToken)
+		if err != nil {
+			return types.ListObjectsResult{}, types.ErrResponse{
+				StatusCode: http.StatusBadRequest,
+				Code:       "InvalidArgument",
+				Message:    "The continuation token provided is incorrect.",
+			}
+		}
+		startAfter = string(token)
+	}
+
+	maxKeys := int(opts.MaxKeys)
+	if maxKeys == 0 {
+		maxKeys = defaultMaxKeys
+	} else if maxKeys > maxMaxKeys {
+		maxKeys = maxMaxKeys
+	}
+
+	var names []string
+	for name := range bucket {
+		if strings.HasPrefix(name, opts.Prefix) && name > startAfter {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var result types.ListObjectsResult
+	if len(names) > maxKeys {
+		names = names[:maxKeys]
+		result.IsTruncated = true
+		result.NextContinuationToken = base64.StdEncoding.EncodeToString([]byte(names[maxKeys-1]))
+	}
+	for _, name := range names {
+		result.Objects = append(result.Objects, &types.ObjectMeta{
+			ObjectInfo: &types.ObjectInfo{
+				BucketName:  bucketName,
+				ObjectName:  name,
+				PayloadSize: uint64(bucket[name].size),
+			},
+		})
+	}
+
+	return result, nil
+}
+
+// GetDefaultAccount returns the account the client acts for
+func (c *Client) GetDefaultAccount() (*types.Account, error) {
+	return c.account, nil
+}
+
+// ComputeHashRoots reads the payload from reader and returns its size along
+// with a checksum that PutObject verifies. Storage providers checksum each
+// erasure-coded piece, but a single checksum serves the same purpose here.
+func (c *Client) ComputeHashRoots(reader io.Reader, isSerial bool) ([][]byte, int64, storagetypes.RedundancyType, error) {
+	h := sha256.New()
+	size, err := io.Copy(h, reader)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	return [][]byte{h.Sum(nil)}, size, storagetypes.REDUNDANCY_EC_TYPE, nil
+}
+
+// GetCreateObjectApproval approves the creation of an object as the
+// primary storage provider of its bucket does
+func (c *Client) GetCreateObjectApproval(ctx context.Context, createObjectMsg *storagetypes.MsgCreateObject) (*storagetypes.MsgCreateObject, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.injectedFailure("GetCreateObjectApproval"); err != nil {
+		return nil, err
+	}
+	if _, err := c.bucket(createObjectMsg.BucketName); err != nil {
+		return nil, err
+	}
+
+	approved := *createObjectMsg
+	approved.PrimarySpApproval = &common.Approval{ExpiredHeight: 1000, Sig: []byte("approved")}
+	return &approved, nil
+}
+
+// BroadcastTx executes msgs, which must all create objects, in one
+// transaction. Nothing is created if any of the names is taken.
+func (c *Client) BroadcastTx(ctx context.Context, msgs []sdk.Msg, txOpt *gnfdsdktypes.TxOption, opts ...grpc.CallOption) (*tx.BroadcastTxResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.injectedFailure("BroadcastTx"); err != nil {
+		return nil, err
+	}
+
+	creates := make([]*storagetypes.MsgCreateObject, len(msgs))
+	for i, msg := range msgs {
+		create, ok := msg.(*storagetypes.MsgCreateObject)
+		if !ok {
+			return nil, fmt.Errorf("unsupported message %T", msg)
+		}
+		if create.PrimarySpApproval == nil || len(create.PrimarySpApproval.Sig) == 0 {
+			return nil, fmt.Errorf("object %s lacks the approval of the storage provider", create.ObjectName)
+		}
+		creates[i] = create
+	}
+
+	txHash, err := c.commit(creates)
+	if err != nil {
+		return nil, err
+	}
+	return &tx.BroadcastTxResponse{TxResponse: &sdk.TxResponse{TxHash: txHash}}, nil
+}
+
+// WaitForTx returns the result of the transaction txHash
+func (c *Client) WaitForTx(ctx context.Context, txHash string) (*ctypes.ResultTx, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.txs[txHash] {
+		return nil, fmt.Errorf("tx %s not found", txHash)
+	}
+	return &ctypes.ResultTx{TxResult: abci.ResponseDeliverTx{Code: 0}}, nil
+}
+
+// FailNext makes the next calls of method, such as "GetObject", fail with
+// errs, one error per call, before the method behaves normally again. A nil
+// error lets its call through. Injected failures happen before the call has
+// any effect.
+func (c *Client) FailNext(method string, errs ...error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.failures[method] = append(c.failures[method], errs...)
+}
+
+// Calls returns how often method has been called, including failed calls
+func (c *Client) Calls(method string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.calls[method]
+}
+
+// Objects returns the names of all objects in a bucket, sealed or not
+func (c *Client) Objects(bucketName string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var names []string
+	for name := range c.buckets[bucketName] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Transactions returns the number of object creation transactions sent so far
+func (c *Client) Transactions() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.txCount
+}
+
+// commit creates the objects of msgs in one transaction and returns its
+// hash. Empty objects are sealed right away, like on chain.
+func (c *Client) commit(msgs []*storagetypes.MsgCreateObject) (string, error) {
+	for _, msg := range msgs {
+		bucket, err := c.bucket(msg.BucketName)
+		if err != nil {
+			return "", err
+		}
+		if _, ok := bucket[msg.ObjectName]; ok {
+			return "", fmt.Errorf("%w: %s/%s", ErrObjectAlreadyExists, msg.BucketName, msg.ObjectName)
+		}
+	}
+
+	c.txCount++
+	txHash := c.newTx()
+	for _, msg := range msgs {
+		var checksum []byte
+		if len(msg.ExpectChecksums) > 0 {
+			checksum = msg.ExpectChecksums[0]
+		}
+		c.buckets[msg.BucketName][msg.ObjectName] = &object{
+			bucketName: msg.BucketName,
+			objectName: msg.ObjectName,
+			txHash:     txHash,
+			size:       int64(msg.PayloadSize),
+			checksum:   checksum,
+			sealed:     msg.PayloadSize == 0,
+		}
+	}
+
+	return txHash, nil
+}
+
+// newTx records a successful transaction and returns its hash
+func (c *Client) newTx() string {
+	txHash := fmt.Sprintf("%064X", len(c.txs)+1)
+	c.txs[txHash] = true
+	return txHash
+}
+
+// injectedFailure counts a call of method and returns the next failure
+// injected for it, if any
+func (c *Client) injectedFailure(method string) error {
+	c.calls[method]++
+
+	errs := c.failures[method]
+	if len(errs) == 0 {
+		return nil
+	}
+	c.failures[method] = errs[1:]
+	return errs[0]
+}
+
+func (c *Client) bucket(bucketName string) (map[string]*object, error) {
+	bucket, ok := c.buckets[bucketName]
+	if !ok {
+		return nil, types.ErrResponse{
+			StatusCode: http.StatusNotFound,
+			Code:       "NoSuchBucket",
+			Message:    "The specified bucket does not exist.",
+		}
+	}
+	return bucket, nil
+}
+
+func (c *Client) object(bucketName, objectName string) (*object, error) {
+	bucket, err := c.bucket(bucketName)
+	if err != nil {
+		return nil, err
+	}
+	obj, ok := bucket[objectName]
+	if !ok {
+		return nil, types.ErrResponse{
+			StatusCode: http.StatusNotFound,
+			Code:       "NoSuchObject",
+			Message:    "The specified object does not exist.",
+		}
+	}
+	return obj, nil
+}
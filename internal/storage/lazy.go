@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// LazyBackend defers creating a Backend until one of its operations is
+// first called, so that commands which never reach the remote storage do
+// not pay for connecting to it or fail when it is misconfigured
+type LazyBackend struct {
+	open func() (Backend, error)
+
+	once    sync.Once
+	backend Backend
+	err     error
+}
+
+// NewLazyBackend creates a backend that calls open on first use and
+// forwards its operations to the result. If open fails, every operation
+// fails with its error.
+func NewLazyBackend(open func() (Backend, error)) *LazyBackend {
+	return &LazyBackend{open: open}
+}
+
+// get returns the underlying backend, creating it on the first call
+func (b *LazyBackend) get() (Backend, error) {
+	b.once.Do(func() {
+		b.backend, b.err = b.open()
+	})
+	return b.backend, b.err
+}
+
+// Put stores data under key
+func (b *LazyBackend) Put(ctx context.Context, key string, data []byte) error {
+	backend, err := b.get()
+	if err != nil {
+		return err
+	}
+	return backend.Put(ctx, key, data)
+}
+
+// PutFrom stores the data read from r under key
+func (b *LazyBackend) PutFrom(ctx context.Context, key string, r io.Reader) error {
+	backend, err := b.get()
+	if err != nil {
+		return err
+	}
+	return backend.PutFrom(ctx, key, r)
+}
+
+// Create stores data under key if the key does not exist yet
+func (b *LazyBackend) Create(ctx context.Context, key string, data []byte) error {
+	backend, err := b.get()
+	if err != nil {
+		return err
+	}
+	return backend.Create(ctx, key, data)
+}
+
+// CreateBatch stores each entry like Create
+func (b *LazyBackend) CreateBatch(ctx context.Context, entries []KeyData) error {
+	backend, err := b.get()
+	if err != nil {
+		return err
+	}
+	return backend.CreateBatch(ctx, entries)
+}
+
+// Get retrieves the data stored under key
+func (b *LazyBackend) Get(ctx context.Context, key string) ([]byte, error) {
+	backend, err := b.get()
+	if err != nil {
+		return nil, err
+	}
+	return backend.Get(ctx, key)
+}
+
+// Open returns a reader of the data stored under key
+func (b *LazyBackend) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	backend, err := b.get()
+	if err != nil {
+		return nil, err
+	}
+	return backend.Open(ctx, key)
+}
+
+// GetRange retrieves length bytes of the data stored under key, starting
+// at offset
+func (b *LazyBackend) GetRange(ctx context.Context, key string, offset, length int64) ([]byte, error) {
+	backend, err := b.get()
+	if err != nil {
+		return nil, err
+	}
+	return backend.GetRange(ctx, key, offset, length)
+}
+
+// Head returns metadata about the data stored under key
+func (b *LazyBackend) Head(ctx context.Context, key string) (*KeyInfo, error) {
+	backend, err := b.get()
+	if err != nil {
+		return nil, err
+	}
+	return backend.Head(ctx, key)
+}
+
+// Delete removes the data stored under key
+func (b *LazyBackend) Delete(ctx context.Context, key string) error {
+	backend, err := b.get()
+	if err != nil {
+		return err
+	}
+	return backend.Delete(ctx, key)
+}
+
+// Walk calls fn for every key that begins with prefix
+func (b *LazyBackend) Walk(ctx context.Context, prefix string, fn func(key string) error) error {
+	backend, err := b.get()
+	if err != nil {
+		return err
+	}
+	return backend.Walk(ctx, prefix, fn)
+}
@@ -0,0 +1,46 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/mindkit-xyz/mindkit-gitk/internal/storage"
+)
+
+func TestLazyBackendOpensOnFirstUse(t *testing.T) {
+	ctx := context.Background()
+	var opened int
+	backend := storage.NewLazyBackend(func() (storage.Backend, error) {
+		opened++
+		return storage.NewLocalBackend(t.TempDir()), nil
+	})
+	if opened != 0 {
+		t.Fatalf("backend opened %d times before use", opened)
+	}
+
+	if err := backend.Put(ctx, "key", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := backend.Get(ctx, "key"); err != nil || string(data) != "data" {
+		t.Fatalf("Get = %q, %v; want %q", data, err, "data")
+	}
+	if opened != 1 {
+		t.Fatalf("backend opened %d times, want once", opened)
+	}
+}
+
+func TestLazyBackendReportsOpenFailure(t *testing.T) {
+	ctx := context.Background()
+	failure := errors.New("no endpoint configured")
+	backend := storage.NewLazyBackend(func() (storage.Backend, error) {
+		return nil, failure
+	})
+
+	if err := backend.Put(ctx, "key", []byte("data")); !errors.Is(err, failure) {
+		t.Fatalf("Put = %v, want %v", err, failure)
+	}
+	if _, err := backend.Head(ctx, "key"); !errors.Is(err, failure) {
+		t.Fatalf("Head = %v, want %v", err, failure)
+	}
+}
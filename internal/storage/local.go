@@ -0,0 +1,282 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// tempPattern is the file name pattern of in-progress writes, which Walk skips
+const tempPattern = ".tmp-*"
+
+// LocalBackend implements Backend on top of a directory in the local filesystem.
+// Each key is stored as a file at the corresponding path below the root.
+type LocalBackend struct {
+	root string
+}
+
+// NewLocalBackend creates a new backend storing keys below the given directory
+func NewLocalBackend(root string) *LocalBackend {
+	return &LocalBackend{
+		root: root,
+	}
+}
+
+// Put writes data to the file for key, replacing it atomically if it exists
+func (b *LocalBackend) Put(ctx context.Context, key string, data []byte) error {
+	return b.PutFrom(ctx, key, bytes.NewReader(data))
+}
+
+// PutFrom copies r to the file for key, replacing it atomically if it exists
+func (b *LocalBackend) PutFrom(ctx context.Context, key string, r io.Reader) error {
+	filePath, err := b.filePath(key)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so readers never see partial data
+	tmpName, err := writeTemp(filePath, r)
+	if err != nil {
+		return localError("write", key, err)
+	}
+	defer os.Remove(tmpName)
+
+	if err := os.Rename(tmpName, filePath); err != nil {
+		return localError("write", key, err)
+	}
+
+	return nil
+}
+
+// Create writes data to the file for key unless the file already exists
+func (b *LocalBackend) Create(ctx context.Context, key string, data []byte) error {
+	filePath, err := b.filePath(key)
+	if err != nil {
+		return err
+	}
+
+	tmpName, err := writeTemp(filePath, bytes.NewReader(data))
+	if err != nil {
+		return localError("write", key, err)
+	}
+	defer os.Remove(tmpName)
+
+	// Unlike rename, link fails if the target exists, which makes the
+	// check and the write a single atomic step
+	if err := os.Link(tmpName, filePath); err != nil {
+		return localError("create", key, err)
+	}
+
+	return nil
+}
+
+// CreateBatch creates the files for all entries one by one, stopping at the
+// first failure
+func (b *LocalBackend) CreateBatch(ctx context.Context, entries []KeyData) error {
+	for _, entry := range entries {
+		if err := b.Create(ctx, entry.Key, entry.Data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Get reads the file for key
+func (b *LocalBackend) Get(ctx context.Context, key string) ([]byte, error) {
+	filePath, err := b.filePath(key)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, localError("read", key, err)
+	}
+
+	return data, nil
+}
+
+// Open opens the file for key
+func (b *LocalBackend) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	filePath, err := b.filePath(key)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, localError("read", key, err)
+	}
+
+	return f, nil
+}
+
+// GetRange reads length bytes of the file for key, starting at offset. The
+// buffer is sized by what the file holds, not by length, which callers may
+// derive from untrusted data.
+func (b *LocalBackend) GetRange(ctx context.Context, key string, offset, length int64) ([]byte, error) {
+	if length <= 0 {
+		return nil, nil
+	}
+
+	filePath, err := b.filePath(key)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, localError("read", key, err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, localError("read", key, err)
+	}
+	if offset >= info.Size() {
+		return nil, nil
+	}
+	if length > info.Size()-offset {
+		length = info.Size() - offset
+	}
+
+	data := make([]byte, length)
+	n, err := f.ReadAt(data, offset)
+	if err != nil && err != io.EOF {
+		return nil, localError("read", key, err)
+	}
+
+	return data[:n], nil
+}
+
+// Head returns the size of the file for key
+func (b *LocalBackend) Head(ctx context.Context, key string) (*KeyInfo, error) {
+	filePath, err := b.filePath(key)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return nil, localError("stat", key, err)
+	}
+
+	return &KeyInfo{
+		Key:  key,
+		Size: info.Size(),
+	}, nil
+}
+
+// Delete removes the file for key
+func (b *LocalBackend) Delete(ctx context.Context, key string) error {
+	filePath, err := b.filePath(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(filePath); err != nil {
+		return localError("delete", key, err)
+	}
+
+	return nil
+}
+
+// Walk calls fn for the key of every file below the root that begins with
+// prefix, in the order of a depth-first walk of the directory tree
+func (b *LocalBackend) Walk(ctx context.Context, prefix string, fn func(key string) error) error {
+	// Only walk the deepest directory that can contain matching keys
+	dir := b.root
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		dir = filepath.Join(b.root, filepath.FromSlash(prefix[:i]))
+	}
+
+	return filepath.WalkDir(dir, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if filePath == dir && os.IsNotExist(err) {
+				return nil
+			}
+			return localError("list", prefix, err)
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if matched, _ := path.Match(tempPattern, d.Name()); matched {
+			return nil
+		}
+
+		rel, err := filepath.Rel(b.root, filePath)
+		if err != nil {
+			return localError("list", prefix, err)
+		}
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			return fn(key)
+		}
+		return nil
+	})
+}
+
+// writeTemp copies r to a new temporary file next to filePath and returns its name
+func writeTemp(filePath string, r io.Reader) (string, error) {
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return "", err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(filePath), tempPattern)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+
+	return tmp.Name(), nil
+}
+
+// filePath maps key to a file path below the root
+func (b *LocalBackend) filePath(key string) (string, error) {
+	rel := filepath.FromSlash(key)
+	if !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("invalid key %q", key)
+	}
+	return filepath.Join(b.root, rel), nil
+}
+
+// localError describes the failure of the operation op on key
+func localError(op, key string, err error) error {
+	return &Error{Op: op, Key: key, Kind: classifyLocal(err), Err: err}
+}
+
+// classifyLocal determines the kind of a file system error
+func classifyLocal(err error) error {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return ErrObjectNotFound
+	case errors.Is(err, fs.ErrExist):
+		return ErrAlreadyExists
+	case errors.Is(err, fs.ErrPermission):
+		return ErrPermissionDenied
+	case errors.Is(err, syscall.ENOSPC), errors.Is(err, syscall.EDQUOT):
+		return ErrQuotaExceeded
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/mindkit-xyz/mindkit-gitk/internal/storage"
+)
+
+func TestLocalBackendCreateRefusesExistingKey(t *testing.T) {
+	ctx := context.Background()
+	backend := storage.NewLocalBackend(t.TempDir())
+
+	if err := backend.Create(ctx, "refs/heads/main", []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.Create(ctx, "refs/heads/main", []byte("second")); !errors.Is(err, storage.ErrAlreadyExists) {
+		t.Fatalf("second Create = %v, want ErrAlreadyExists", err)
+	}
+	if data, err := backend.Get(ctx, "refs/heads/main"); err != nil || string(data) != "first" {
+		t.Fatalf("Get = %q, %v; want %q", data, err, "first")
+	}
+
+	if err := backend.Put(ctx, "refs/heads/main", []byte("third")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := backend.Get(ctx, "refs/heads/main"); err != nil || string(data) != "third" {
+		t.Fatalf("Get after Put = %q, %v; want %q", data, err, "third")
+	}
+}
+
+func TestLocalBackendMissingKey(t *testing.T) {
+	ctx := context.Background()
+	backend := storage.NewLocalBackend(t.TempDir())
+
+	if _, err := backend.Get(ctx, "missing"); !errors.Is(err, storage.ErrObjectNotFound) {
+		t.Errorf("Get = %v, want ErrObjectNotFound", err)
+	}
+	if _, err := backend.Head(ctx, "missing"); !errors.Is(err, storage.ErrObjectNotFound) {
+		t.Errorf("Head = %v, want ErrObjectNotFound", err)
+	}
+	if err := backend.Delete(ctx, "missing"); !errors.Is(err, storage.ErrObjectNotFound) {
+		t.Errorf("Delete = %v, want ErrObjectNotFound", err)
+	}
+	if _, err := backend.GetRange(ctx, "missing", 0, 1); !errors.Is(err, storage.ErrObjectNotFound) {
+		t.Errorf("GetRange = %v, want ErrObjectNotFound", err)
+	}
+}
+
+func TestLocalBackendGetRange(t *testing.T) {
+	ctx := context.Background()
+	backend := storage.NewLocalBackend(t.TempDir())
+	if err := backend.Put(ctx, "pack", []byte("0123456789")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		offset, length int64
+		want           string
+	}{
+		{0, 4, "0123"},
+		{6, 4, "6789"},
+		{8, 100, "89"},
+		{8, 1 << 62, "89"},
+		{10, 1, ""},
+		{20, 1, ""},
+		{3, 0, ""},
+		{3, -1, ""},
+	} {
+		data, err := backend.GetRange(ctx, "pack", tt.offset, tt.length)
+		if err != nil {
+			t.Errorf("GetRange(%d, %d) failed: %v", tt.offset, tt.length, err)
+			continue
+		}
+		if string(data) != tt.want {
+			t.Errorf("GetRange(%d, %d) = %q, want %q", tt.offset, tt.length, data, tt.want)
+		}
+	}
+}
+
+func TestLocalBackendWalk(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	backend := storage.NewLocalBackend(root)
+
+	for _, key := range []string{"objects/ab/cdef", "objects/12/3456", "refs/heads/main"} {
+		if err := backend.Put(ctx, key, []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Left behind by an interrupted write
+	if err := os.WriteFile(filepath.Join(root, "objects", "ab", ".tmp-123"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	if err := backend.Walk(ctx, "objects/", func(key string) error {
+		keys = append(keys, key)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"objects/12/3456", "objects/ab/cdef"}; !reflect.DeepEqual(keys, want) {
+		t.Fatalf("Walk = %v, want %v", keys, want)
+	}
+
+	if err := backend.Walk(ctx, "missing/", func(key string) error {
+		t.Errorf("Walk reported %s below a missing directory", key)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLocalBackendRejectsKeysOutsideRoot(t *testing.T) {
+	ctx := context.Background()
+	backend := storage.NewLocalBackend(t.TempDir())
+
+	for _, key := range []string{"../escape", "/etc/passwd", ""} {
+		if err := backend.Put(ctx, key, []byte("data")); err == nil {
+			t.Errorf("Put(%q) succeeded", key)
+		}
+	}
+}
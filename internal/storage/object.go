@@ -1,124 +1,404 @@
 package storage
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"path"
-
-	gsdk "github.com/bnb-chain/greenfield-go-sdk/client"
-	"github.com/bnb-chain/greenfield-go-sdk/types"
+	"sync"
 )
 
-// ObjectStorage implements storage for Git objects in BNB Greenfield
+// ObjectStorage implements storage for Git objects on a storage backend
 type ObjectStorage struct {
-	client     *gsdk.GreenfieldClient
-	bucketName string
-	prefix     string
+	backend Backend
+	prefix  string
+
+	// have holds the hashes of objects known to be stored already
+	mu   sync.Mutex
+	have map[string]bool
+
+	// packs holds the packfiles on the backend, whose indexes are read on
+	// first use. loadMu serializes the reading, which packMu is not held
+	// for, so that lookups in the packs already loaded go on meanwhile.
+	loadMu      sync.Mutex
+	packMu      sync.Mutex
+	packs       []*packFile
+	packsLoaded bool
+	bases       baseCache
+
+	// cache, if not nil, keeps the objects read across runs
+	cache *ObjectCache
 }
 
 // NewObjectStorage creates a new object storage instance
-func NewObjectStorage(client *gsdk.GreenfieldClient, bucketName, prefix string) *ObjectStorage {
+func NewObjectStorage(backend Backend, prefix string) *ObjectStorage {
 	return &ObjectStorage{
-		client:     client,
-		bucketName: bucketName,
-		prefix:     prefix,
-	}
-}
-
-// Store stores a Git object in BNB Greenfield
-func (s *ObjectStorage) Store(ctx context.Context, hash string, data []byte) error {
-	objectPath := path.Join(s.prefix, "objects", hash[:2], hash[2:])
-	
-	createObjectTx, err := s.client.CreateObject(
-		ctx,
-		s.bucketName,
-		objectPath,
-		types.CreateObjectOptions{},
-	)
+		backend: backend,
+		prefix:  prefix,
+		have:    make(map[string]bool),
+	}
+}
+
+// SetCache puts cache in front of the backend: objects are read from the
+// cache when they are in it, and added to it when read from the backend
+func (s *ObjectStorage) SetCache(cache *ObjectCache) {
+	s.cache = cache
+}
+
+// Store stores a Git object on the backend in loose object format and
+// reports whether it was uploaded. Objects are content-addressed, so one
+// that is already stored is skipped rather than uploaded again.
+func (s *ObjectStorage) Store(ctx context.Context, hash, objType string, data []byte) (bool, error) {
+	stored, err := s.isStored(ctx, hash)
+	if err != nil || stored {
+		return false, err
+	}
+
+	raw, err := EncodeLooseObject(objType, data)
 	if err != nil {
-		return fmt.Errorf("failed to create object: %w", err)
+		return false, fmt.Errorf("failed to encode object %s: %w", hash, err)
 	}
 
-	// Upload the object data
-	if err := s.client.UploadObject(
-		ctx,
-		createObjectTx,
-		data,
-		types.UploadObjectOptions{},
-	); err != nil {
-		return fmt.Errorf("failed to upload object: %w", err)
+	objectPath := s.objectPath(hash)
+	err = s.backend.Create(ctx, objectPath, raw)
+	if errors.Is(err, ErrAlreadyExists) {
+		// Stored concurrently, or left behind by an interrupted upload
+		stored, err = s.isStored(ctx, hash)
+		if err != nil || stored {
+			return false, err
+		}
+		err = s.recreate(ctx, objectPath, raw)
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to store object %s: %w", hash, err)
 	}
 
+	s.markHave(hash)
+	return true, nil
+}
+
+// recreate replaces the object at objectPath, which exists but cannot be
+// read, such as a Greenfield object whose upload never completed, with raw
+func (s *ObjectStorage) recreate(ctx context.Context, objectPath string, raw []byte) error {
+	if err := s.backend.Delete(ctx, objectPath); err != nil && !errors.Is(err, ErrObjectNotFound) {
+		return err
+	}
+	return s.backend.Create(ctx, objectPath, raw)
+}
+
+// StoreFrom stores a Git object of objType whose size bytes of content are
+// read from r, and reports whether it was uploaded. The object is
+// compressed while it is uploaded and never held in memory as a whole. Its
+// content is hashed on the way, and nothing is stored if the hash does not
+// match hash.
+func (s *ObjectStorage) StoreFrom(ctx context.Context, hash, objType string, size int64, r io.Reader) (bool, error) {
+	stored, err := s.isStored(ctx, hash)
+	if err != nil || stored {
+		return false, err
+	}
+
+	// The backend reads the compressed object from the pipe as the object
+	// writer fills it. A failure on either side aborts the other.
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pw.CloseWithError(writeObject(pw, hash, objType, size, r))
+	}()
+
+	err = s.backend.PutFrom(ctx, s.objectPath(hash), pr)
+	pr.CloseWithError(errors.New("upload ended"))
+	// The writer may still be reading r, which belongs to the caller
+	<-done
+	if err != nil {
+		return false, fmt.Errorf("failed to store object %s: %w", hash, err)
+	}
+
+	s.markHave(hash)
+	return true, nil
+}
+
+// writeObject writes the object read from r to w in loose object format,
+// failing if it does not hash to hash
+func writeObject(w io.Writer, hash, objType string, size int64, r io.Reader) error {
+	ow, err := NewObjectWriter(w, objType, size)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(ow, r); err != nil {
+		return err
+	}
+	if err := ow.Close(); err != nil {
+		return err
+	}
+	if ow.Hash() != hash {
+		return fmt.Errorf("object content hashes to %s, expected %s", ow.Hash(), hash)
+	}
 	return nil
 }
 
-// Get retrieves a Git object from BNB Greenfield
-func (s *ObjectStorage) Get(ctx context.Context, hash string) ([]byte, error) {
-	objectPath := path.Join(s.prefix, "objects", hash[:2], hash[2:])
-	
-	// Get object info
-	_, err := s.client.HeadObject(
-		ctx,
-		s.bucketName,
-		objectPath,
-		types.HeadObjectOptions{},
-	)
+// isStored reports whether the object hash is on the backend already,
+// loose or packed
+func (s *ObjectStorage) isStored(ctx context.Context, hash string) (bool, error) {
+	if s.has(hash) {
+		return true, nil
+	}
+
+	if err := s.loadPacks(ctx, false); err != nil {
+		return false, err
+	}
+	if s.findPacked(hash) != nil {
+		s.markHave(hash)
+		return true, nil
+	}
+
+	_, err := s.backend.Head(ctx, s.objectPath(hash))
+	if errors.Is(err, ErrObjectNotFound) {
+		return false, nil
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to head object: %w", err)
+		return false, fmt.Errorf("failed to check object %s: %w", hash, err)
 	}
 
-	// Download the object
-	data, err := s.client.GetObject(
-		ctx,
-		s.bucketName,
-		objectPath,
-		types.GetObjectOptions{},
-	)
+	s.markHave(hash)
+	return true, nil
+}
+
+func (s *ObjectStorage) objectPath(hash string) string {
+	return path.Join(s.prefix, "objects", hash[:2], hash[2:])
+}
+
+func (s *ObjectStorage) has(hash string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.have[hash]
+}
+
+func (s *ObjectStorage) markHave(hash string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.have[hash] = true
+}
+
+// Get retrieves a Git object from the cache or the backend and returns its
+// type and content. Packs are looked up through their indexes before loose
+// objects. The error matches ErrObjectNotFound if the object does not exist.
+func (s *ObjectStorage) Get(ctx context.Context, hash string) (string, []byte, error) {
+	if s.cache == nil {
+		return s.get(ctx, hash)
+	}
+
+	if objType, data, ok := s.cache.Get(hash); ok {
+		return objType, data, nil
+	}
+	objType, data, err := s.get(ctx, hash)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get object: %w", err)
+		return "", nil, err
 	}
 
-	return data, nil
+	// A failure to cache only costs a download next time
+	s.cache.Put(hash, objType, data)
+	return objType, data, nil
 }
 
-// Delete removes a Git object from BNB Greenfield
-func (s *ObjectStorage) Delete(ctx context.Context, hash string) error {
-	objectPath := path.Join(s.prefix, "objects", hash[:2], hash[2:])
-	
-	if err := s.client.DeleteObject(
-		ctx,
-		s.bucketName,
-		objectPath,
-		types.DeleteObjectOptions{},
-	); err != nil {
-		return fmt.Errorf("failed to delete object: %w", err)
+// get retrieves a Git object from the backend
+func (s *ObjectStorage) get(ctx context.Context, hash string) (string, []byte, error) {
+	if err := s.loadPacks(ctx, false); err != nil {
+		return "", nil, err
+	}
+	objType, data, err := s.getPacked(ctx, hash)
+	if !errors.Is(err, ErrObjectNotFound) {
+		return objType, data, err
 	}
 
-	return nil
+	raw, err := s.backend.Get(ctx, s.objectPath(hash))
+	if errors.Is(err, ErrObjectNotFound) {
+		// The object may be in a pack stored since the indexes were read
+		if err := s.loadPacks(ctx, true); err != nil {
+			return "", nil, err
+		}
+		if objType, data, err := s.getPacked(ctx, hash); !errors.Is(err, ErrObjectNotFound) {
+			return objType, data, err
+		}
+	}
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to get object %s: %w", hash, err)
+	}
+
+	objType, data, err = DecodeLooseObject(raw)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to decode object %s: %w", hash, err)
+	}
+
+	return objType, data, nil
 }
 
-// List lists all Git objects in BNB Greenfield
-func (s *ObjectStorage) List(ctx context.Context) ([]string, error) {
-	prefix := path.Join(s.prefix, "objects")
-	
-	objects, err := s.client.ListObjects(
-		ctx,
-		s.bucketName,
-		types.ListObjectsOptions{
-			Prefix: prefix,
-		},
-	)
+// Open returns the type and size of a Git object and a reader of its
+// content, which the caller must close. Loose objects are decompressed and
+// hashed as they are read, and the reader fails at the end of the content
+// if it does not match hash. Packed objects are read whole into memory
+// first, since deltas are resolved against their bases in memory, and
+// cached objects are too.
+func (s *ObjectStorage) Open(ctx context.Context, hash string) (string, int64, io.ReadCloser, error) {
+	if s.cache != nil {
+		if objType, data, ok := s.cache.Get(hash); ok {
+			return objType, int64(len(data)), io.NopCloser(bytes.NewReader(data)), nil
+		}
+	}
+
+	if err := s.loadPacks(ctx, false); err != nil {
+		return "", 0, nil, err
+	}
+	if s.findPacked(hash) != nil {
+		objType, data, err := s.Get(ctx, hash)
+		if err != nil {
+			return "", 0, nil, err
+		}
+		return objType, int64(len(data)), io.NopCloser(bytes.NewReader(data)), nil
+	}
+
+	rc, err := s.backend.Open(ctx, s.objectPath(hash))
+	if errors.Is(err, ErrObjectNotFound) {
+		// The object may be in a pack stored since the indexes were read
+		objType, data, err := s.Get(ctx, hash)
+		if err != nil {
+			return "", 0, nil, err
+		}
+		return objType, int64(len(data)), io.NopCloser(bytes.NewReader(data)), nil
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to list objects: %w", err)
+		return "", 0, nil, fmt.Errorf("failed to get object %s: %w", hash, err)
 	}
 
+	objType, size, content, err := OpenLooseObject(rc)
+	if err != nil {
+		rc.Close()
+		return "", 0, nil, fmt.Errorf("failed to decode object %s: %w", hash, err)
+	}
+
+	h := sha1.New()
+	fmt.Fprintf(h, "%s %d\x00", objType, size)
+	return objType, size, &verifyingReader{
+		r:      io.TeeReader(content, h),
+		h:      h,
+		want:   hash,
+		left:   size,
+		closer: func() error { content.Close(); return rc.Close() },
+	}, nil
+}
+
+// verifyingReader reads the content of an object and checks at its end
+// that it has the expected size and hash
+type verifyingReader struct {
+	r      io.Reader
+	h      hash.Hash
+	want   string
+	left   int64
+	closer func() error
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.left -= int64(n)
+	if err == io.EOF {
+		if r.left != 0 {
+			return n, fmt.Errorf("object %s is truncated: %w", r.want, io.ErrUnexpectedEOF)
+		}
+		if got := hex.EncodeToString(r.h.Sum(nil)); got != r.want {
+			return n, fmt.Errorf("object %s is corrupt: content hashes to %s", r.want, got)
+		}
+	}
+	return n, err
+}
+
+func (r *verifyingReader) Close() error {
+	return r.closer()
+}
+
+// StoreObject serializes and stores a Git object and returns its hash
+func (s *ObjectStorage) StoreObject(ctx context.Context, obj GitObject) (string, error) {
+	data, err := obj.Serialize()
+	if err != nil {
+		return "", fmt.Errorf("failed to serialize %s: %w", obj.Type(), err)
+	}
+	hash := HashObject(obj.Type(), data)
+	if _, err := s.Store(ctx, hash, obj.Type(), data); err != nil {
+		return "", err
+	}
+	return hash, nil
+}
+
+// GetObject retrieves and parses a Git object
+func (s *ObjectStorage) GetObject(ctx context.Context, hash string) (GitObject, error) {
+	objType, data, err := s.Get(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	obj, err := ParseObject(objType, data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse object %s: %w", hash, err)
+	}
+
+	return obj, nil
+}
+
+// Delete removes a Git object from the backend
+func (s *ObjectStorage) Delete(ctx context.Context, hash string) error {
+	// Packed objects stay in their packs
+	if err := s.backend.Delete(ctx, s.objectPath(hash)); err != nil {
+		return fmt.Errorf("failed to delete object %s: %w", hash, err)
+	}
+
+	return nil
+}
+
+// List lists all Git objects on the backend. Use ForEach for large
+// repositories, where the hashes may not fit in memory.
+func (s *ObjectStorage) List(ctx context.Context) ([]string, error) {
 	var hashes []string
-	for _, obj := range objects.Objects {
-		// Extract hash from object path
-		hash := path.Base(obj.ObjectInfo.ObjectName)
+	err := s.ForEach(ctx, func(hash string) error {
 		hashes = append(hashes, hash)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	return hashes, nil
 }
+
+// ForEach calls fn with the hash of every Git object on the backend, loose
+// or packed, stopping at the first error fn returns
+func (s *ObjectStorage) ForEach(ctx context.Context, fn func(hash string) error) error {
+	if err := s.loadPacks(ctx, true); err != nil {
+		return err
+	}
+	if err := s.forEachPacked(s.loadedPacks(), fn); err != nil {
+		return err
+	}
+
+	return s.forEachLoose(ctx, fn)
+}
+
+// forEachLoose calls fn with the hash of every loose object that is not in
+// one of the loaded packs
+func (s *ObjectStorage) forEachLoose(ctx context.Context, fn func(hash string) error) error {
+	prefix := path.Join(s.prefix, "objects") + "/"
+	return s.backend.Walk(ctx, prefix, func(key string) error {
+		// Extract hash from object path, skipping packs and other files
+		dir, file := path.Split(key)
+		hash := path.Base(dir) + file
+		if len(hash) != 40 || len(file) != 38 || s.findPacked(hash) != nil {
+			return nil
+		}
+		return fn(hash)
+	})
+}
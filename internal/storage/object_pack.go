@@ -0,0 +1,512 @@
+package storage
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// DefaultUnpackLimit is the number of objects from which a push is uploaded
+// as a packfile rather than as loose objects, as with git's
+// transfer.unpackLimit
+const DefaultUnpackLimit = 100
+
+// PackOptions configures the delta compression of packs
+type PackOptions struct {
+	// Window is the number of objects each object is compared with to find
+	// a delta base. Zero disables delta compression.
+	Window int
+	// Depth is the maximum length of delta chains. Longer chains compress
+	// better but take longer to read.
+	Depth int
+}
+
+// DefaultPackOptions are git's defaults
+var DefaultPackOptions = PackOptions{Window: 10, Depth: 50}
+
+// packFile is a packfile on the backend
+type packFile struct {
+	// name is the key of the packfile without its extension
+	name  string
+	index *packIndex
+	// size is the size of the packfile, looked up on first use
+	size int64
+}
+
+// packDir returns the key prefix of the packfiles
+func (s *ObjectStorage) packDir() string {
+	return path.Join(s.prefix, "objects", "pack") + "/"
+}
+
+// StorePack stores the objects hashes, loading each through load, as a
+// single packfile along with its index, and reports how many were uploaded.
+// Objects known to be stored already are skipped.
+func (s *ObjectStorage) StorePack(ctx context.Context, hashes []string, load ObjectLoader, opts PackOptions) (BatchResult, error) {
+	var result BatchResult
+	if err := s.loadPacks(ctx, false); err != nil {
+		return result, err
+	}
+
+	var pending []string
+	for _, hash := range hashes {
+		if s.has(hash) || s.findPacked(hash) != nil {
+			result.Skipped++
+			continue
+		}
+		pending = append(pending, hash)
+	}
+	if len(pending) == 0 {
+		return result, nil
+	}
+
+	if _, err := s.writePack(ctx, pending, load, opts); err != nil {
+		return result, err
+	}
+
+	for _, hash := range pending {
+		s.markHave(hash)
+	}
+	result.Uploaded = len(pending)
+
+	return result, nil
+}
+
+// writePack uploads the objects hashes, loading each through load, as a new
+// pack and returns it. Each object is loaded twice: first for its type and
+// size, to order the objects for delta compression, then to be written, so
+// that only the objects of the delta window are held in memory. The pack
+// is written to a temporary file and uploaded from there.
+func (s *ObjectStorage) writePack(ctx context.Context, hashes []string, load ObjectLoader, opts PackOptions) (*packFile, error) {
+	objects := make([]packObjectInfo, 0, len(hashes))
+	for _, hash := range hashes {
+		objType, size, content, err := load(ctx, hash)
+		if err != nil {
+			return nil, err
+		}
+		content.Close()
+		objects = append(objects, packObjectInfo{hash: hash, objType: objType, size: size})
+	}
+	sortPackObjects(objects)
+
+	f, err := os.CreateTemp("", "gitk-pack-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode pack: %w", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	pw, err := newPackWriter(f, len(objects), opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode pack: %w", err)
+	}
+	for _, obj := range objects {
+		objType, size, content, err := load(ctx, obj.hash)
+		if err != nil {
+			return nil, err
+		}
+		data, err := readContent(content, size)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load object %s: %w", obj.hash, err)
+		}
+		if got := HashObject(objType, data); got != obj.hash {
+			return nil, fmt.Errorf("failed to load object %s: content hashes to %s", obj.hash, got)
+		}
+		if err := pw.write(PackObject{Hash: obj.hash, Type: objType, Data: data}); err != nil {
+			return nil, fmt.Errorf("failed to encode pack: %w", err)
+		}
+	}
+	idxData, checksum, err := pw.close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode pack: %w", err)
+	}
+	index, err := parsePackIndex(idxData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode pack: %w", err)
+	}
+	pack := &packFile{name: s.packDir() + "pack-" + checksum, index: index, size: pw.offset}
+
+	// Packs are found through their indexes, so uploading the index last
+	// keeps readers from seeing a pack that is not complete. Both are named
+	// after the pack checksum, so a key that exists already holds the same
+	// content, unless left behind by an interrupted upload.
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to store pack %s: %w", path.Base(pack.name), err)
+	}
+	if err := s.backend.PutFrom(ctx, pack.name+".pack", f); err != nil {
+		return nil, fmt.Errorf("failed to store pack %s: %w", path.Base(pack.name), err)
+	}
+	err = s.backend.Create(ctx, pack.name+".idx", idxData)
+	if errors.Is(err, ErrAlreadyExists) {
+		err = s.backend.Put(ctx, pack.name+".idx", idxData)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to store pack %s: %w", path.Base(pack.name), err)
+	}
+
+	s.packMu.Lock()
+	defer s.packMu.Unlock()
+	for _, known := range s.packs {
+		if known.name == pack.name {
+			return known, nil
+		}
+	}
+	s.packs = append(s.packs, pack)
+
+	return pack, nil
+}
+
+// Repack rewrites all objects on the backend, loose and packed, into a
+// single pack compressed as configured by opts, then removes the loose
+// objects and packs it replaces. It returns the number of objects packed.
+// Objects stored by others while it runs are left as they are. Only the
+// hashes of the objects are held in memory, along with the objects of the
+// delta window.
+func (s *ObjectStorage) Repack(ctx context.Context, opts PackOptions) (int, error) {
+	if err := s.loadPacks(ctx, true); err != nil {
+		return 0, err
+	}
+	oldPacks := s.loadedPacks()
+
+	var hashes, loose []string
+	// Objects in packs stored meanwhile are neither read nor removed
+	if err := s.forEachPacked(oldPacks, func(hash string) error {
+		hashes = append(hashes, hash)
+		return nil
+	}); err != nil {
+		return 0, fmt.Errorf("failed to list objects: %w", err)
+	}
+	err := s.forEachLoose(ctx, func(hash string) error {
+		loose = append(loose, hash)
+		hashes = append(hashes, hash)
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to list objects: %w", err)
+	}
+	if len(hashes) == 0 {
+		return 0, nil
+	}
+
+	pack, err := s.writePack(ctx, hashes, s.Open, opts)
+	if err != nil {
+		return 0, err
+	}
+
+	// Indexes go first, so that readers stop looking into a pack before it
+	// disappears
+	replaced := make(map[string]bool)
+	for _, old := range oldPacks {
+		if old.name == pack.name {
+			continue
+		}
+		for _, ext := range []string{".idx", ".pack"} {
+			if err := s.backend.Delete(ctx, old.name+ext); err != nil {
+				return 0, fmt.Errorf("failed to delete pack %s: %w", path.Base(old.name), err)
+			}
+		}
+		replaced[old.name] = true
+	}
+	for _, hash := range loose {
+		if err := s.Delete(ctx, hash); err != nil {
+			return 0, err
+		}
+	}
+
+	s.packMu.Lock()
+	defer s.packMu.Unlock()
+	packs := s.packs[:0:0]
+	for _, known := range s.packs {
+		if !replaced[known.name] {
+			packs = append(packs, known)
+		}
+	}
+	s.packs = packs
+
+	return len(hashes), nil
+}
+
+// loadPacks reads the indexes of the packfiles on the backend, once unless
+// reload is set. A reload only reads the indexes of new packs, and forgets
+// packs that were removed.
+func (s *ObjectStorage) loadPacks(ctx context.Context, reload bool) error {
+	s.loadMu.Lock()
+	defer s.loadMu.Unlock()
+
+	s.packMu.Lock()
+	loaded := s.packsLoaded
+	known := make(map[string]*packFile, len(s.packs))
+	for _, pack := range s.packs {
+		known[pack.name] = pack
+	}
+	s.packMu.Unlock()
+
+	if loaded && !reload {
+		return nil
+	}
+
+	var names []string
+	err := s.backend.Walk(ctx, s.packDir(), func(key string) error {
+		name, ok := strings.CutSuffix(key, ".idx")
+		if ok && path.Dir(key)+"/" == s.packDir() {
+			names = append(names, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list packs: %w", err)
+	}
+
+	packs := make([]*packFile, 0, len(names))
+	listed := make(map[string]bool, len(names))
+	for _, name := range names {
+		listed[name] = true
+		if pack, ok := known[name]; ok {
+			packs = append(packs, pack)
+			continue
+		}
+
+		data, err := s.backend.Get(ctx, name+".idx")
+		if err != nil {
+			return fmt.Errorf("failed to get index of pack %s: %w", path.Base(name), err)
+		}
+		index, err := parsePackIndex(data)
+		if err != nil {
+			return fmt.Errorf("failed to parse index of pack %s: %w", path.Base(name), err)
+		}
+		packs = append(packs, &packFile{name: name, index: index})
+	}
+
+	s.packMu.Lock()
+	defer s.packMu.Unlock()
+
+	// Keep the packs written while the indexes were read, which the listing
+	// may have missed
+	for _, pack := range s.packs {
+		if !listed[pack.name] && known[pack.name] == nil {
+			packs = append(packs, pack)
+		}
+	}
+	s.packs = packs
+	s.packsLoaded = true
+	return nil
+}
+
+// findPacked returns the loaded pack that holds the object hash, or nil
+func (s *ObjectStorage) findPacked(hash string) *packFile {
+	s.packMu.Lock()
+	defer s.packMu.Unlock()
+
+	for _, pack := range s.packs {
+		if _, ok := pack.index.find(hash); ok {
+			return pack
+		}
+	}
+	return nil
+}
+
+// getPacked reads the object hash from the pack holding it. The error
+// matches ErrObjectNotFound if no loaded pack holds the object.
+func (s *ObjectStorage) getPacked(ctx context.Context, hash string) (string, []byte, error) {
+	pack := s.findPacked(hash)
+	if pack == nil {
+		return "", nil, ErrObjectNotFound
+	}
+
+	offset, _ := pack.index.find(hash)
+	objType, data, err := s.readPacked(ctx, pack, offset)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read object %s from pack %s: %w", hash, path.Base(pack.name), err)
+	}
+
+	// The cache keeps its own copy
+	return objType, bytes.Clone(data), nil
+}
+
+// readPacked reads the object at offset in pack, fetching only its entry
+// and those of its delta bases. Objects read are cached, as the same bases
+// serve many deltas.
+func (s *ObjectStorage) readPacked(ctx context.Context, pack *packFile, offset int64) (string, []byte, error) {
+	key := baseCacheKey{pack: pack.name, offset: offset}
+	if objType, data, ok := s.bases.get(key); ok {
+		return objType, data, nil
+	}
+
+	entry, err := s.readEntry(ctx, pack, offset)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var objType string
+	var data []byte
+	if !entry.isDelta() {
+		objType = packTypeNames[entry.typeNum]
+		if data, err = entry.inflate(); err != nil {
+			return "", nil, fmt.Errorf("failed to inflate object at offset %d: %w", offset, err)
+		}
+	} else {
+		// Bases of REF_DELTA entries are looked up in the same pack first
+		var base []byte
+		if entry.typeNum == packOfsDelta {
+			objType, base, err = s.readPacked(ctx, pack, entry.baseOffset)
+		} else if baseOffset, ok := pack.index.find(entry.baseHash); ok {
+			objType, base, err = s.readPacked(ctx, pack, baseOffset)
+		} else {
+			objType, base, err = s.Get(ctx, entry.baseHash)
+		}
+		if err != nil {
+			return "", nil, err
+		}
+
+		delta, err := entry.inflate()
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to inflate delta at offset %d: %w", offset, err)
+		}
+		if data, err = applyDelta(base, delta); err != nil {
+			return "", nil, fmt.Errorf("failed to apply delta at offset %d: %w", offset, err)
+		}
+	}
+
+	s.bases.add(key, objType, data)
+	return objType, data, nil
+}
+
+// readEntry fetches the entry at offset in pack, whose end the index tells
+func (s *ObjectStorage) readEntry(ctx context.Context, pack *packFile, offset int64) (*packEntry, error) {
+	size, err := s.packSize(ctx, pack)
+	if err != nil {
+		return nil, err
+	}
+
+	end := pack.index.entryEnd(offset, size)
+	if offset < 12 || end <= offset {
+		return nil, fmt.Errorf("invalid pack offset %d", offset)
+	}
+	raw, err := s.backend.GetRange(ctx, pack.name+".pack", offset, end-offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pack %s: %w", path.Base(pack.name), err)
+	}
+
+	return parsePackEntry(raw, offset)
+}
+
+// packSize returns the size of pack, looking it up on first use. The
+// lookup happens without holding packMu; concurrent first uses may both
+// make it.
+func (s *ObjectStorage) packSize(ctx context.Context, pack *packFile) (int64, error) {
+	s.packMu.Lock()
+	size := pack.size
+	s.packMu.Unlock()
+	if size != 0 {
+		return size, nil
+	}
+
+	info, err := s.backend.Head(ctx, pack.name+".pack")
+	if err != nil {
+		return 0, fmt.Errorf("failed to get pack %s: %w", path.Base(pack.name), err)
+	}
+
+	s.packMu.Lock()
+	defer s.packMu.Unlock()
+	pack.size = info.Size
+	return pack.size, nil
+}
+
+// loadedPacks returns the packs loaded so far
+func (s *ObjectStorage) loadedPacks() []*packFile {
+	s.packMu.Lock()
+	defer s.packMu.Unlock()
+
+	return s.packs
+}
+
+// forEachPacked calls fn with the hash of every object in packs. Objects
+// held by several packs are reported once.
+func (s *ObjectStorage) forEachPacked(packs []*packFile, fn func(hash string) error) error {
+	for i, pack := range packs {
+	next:
+		for j := 0; j < pack.index.count(); j++ {
+			hash := pack.index.hash(j)
+			for _, earlier := range packs[:i] {
+				if _, ok := earlier.index.find(hash); ok {
+					continue next
+				}
+			}
+			if err := fn(hash); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// baseCacheLimit bounds the total size of the objects kept by baseCache
+const baseCacheLimit = 64 << 20
+
+// baseCacheKey locates an object in a pack
+type baseCacheKey struct {
+	pack   string
+	offset int64
+}
+
+// baseCacheEntry is an object kept by baseCache
+type baseCacheEntry struct {
+	key     baseCacheKey
+	objType string
+	data    []byte
+}
+
+// baseCache keeps the objects read from packs most recently, up to
+// baseCacheLimit bytes, so that the bases of delta chains are read once.
+// The zero value is an empty cache.
+type baseCache struct {
+	mu      sync.Mutex
+	size    int
+	order   list.List
+	entries map[baseCacheKey]*list.Element
+}
+
+func (c *baseCache) get(key baseCacheKey) (string, []byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return "", nil, false
+	}
+	c.order.MoveToFront(elem)
+	entry := elem.Value.(*baseCacheEntry)
+	return entry.objType, entry.data, true
+}
+
+func (c *baseCache) add(key baseCacheKey, objType string, data []byte) {
+	if len(data) > baseCacheLimit/4 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.entries == nil {
+		c.entries = make(map[baseCacheKey]*list.Element)
+	}
+	if _, ok := c.entries[key]; ok {
+		return
+	}
+	c.entries[key] = c.order.PushFront(&baseCacheEntry{key: key, objType: objType, data: data})
+	c.size += len(data)
+
+	for c.size > baseCacheLimit {
+		oldest := c.order.Back()
+		entry := c.order.Remove(oldest).(*baseCacheEntry)
+		delete(c.entries, entry.key)
+		c.size -= len(entry.data)
+	}
+}
@@ -0,0 +1,123 @@
+package storage_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/mindkit-xyz/mindkit-gitk/internal/storage"
+	"github.com/mindkit-xyz/mindkit-gitk/internal/storage/greenfieldtest"
+)
+
+// similarBlobs returns count blobs that differ only in their last line, by
+// hash, and their total size
+func similarBlobs(count int) (map[string][]byte, int64) {
+	common := bytes.Repeat([]byte("the same line in every version\n"), 256)
+	blobs := make(map[string][]byte)
+	var size int64
+	for i := 0; i < count; i++ {
+		data := append(bytes.Clone(common), fmt.Sprintf("version %d\n", i)...)
+		blobs[storage.HashObject(storage.BlobObject, data)] = data
+		size += int64(len(data))
+	}
+	return blobs, size
+}
+
+// packSizes returns the sizes of the packfiles in the bucket
+func packSizes(t *testing.T, client *greenfieldtest.Client, backend storage.Backend) []int64 {
+	t.Helper()
+
+	var sizes []int64
+	for _, name := range client.Objects(greenfieldtest.Bucket) {
+		if !strings.HasSuffix(name, ".pack") {
+			continue
+		}
+		info, err := backend.Head(context.Background(), name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes = append(sizes, info.Size)
+	}
+	return sizes
+}
+
+func TestStorePackCompressesSimilarObjects(t *testing.T) {
+	ctx := context.Background()
+	client, backend := greenfieldtest.NewBackend()
+	store := storage.NewObjectStorage(backend, "repo")
+
+	blobs, total := similarBlobs(20)
+	var hashes []string
+	for hash := range blobs {
+		hashes = append(hashes, hash)
+	}
+	result, err := store.StorePack(ctx, hashes, blobLoader(blobs), storage.DefaultPackOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Uploaded != len(blobs) {
+		t.Fatalf("uploaded %d objects, want %d", result.Uploaded, len(blobs))
+	}
+
+	// All but the first blob are stored as deltas
+	sizes := packSizes(t, client, backend)
+	if len(sizes) != 1 {
+		t.Fatalf("bucket holds %d packs, want 1", len(sizes))
+	}
+	if sizes[0] > total/10 {
+		t.Errorf("pack of %d bytes of similar blobs is %d bytes", total, sizes[0])
+	}
+
+	// A fresh store reads the objects through the uploaded index
+	fresh := storage.NewObjectStorage(backend, "repo")
+	for hash, data := range blobs {
+		if _, got, err := fresh.Get(ctx, hash); err != nil || !bytes.Equal(got, data) {
+			t.Errorf("object %s: got %d bytes, %v; want %d bytes", hash, len(got), err, len(data))
+		}
+	}
+}
+
+func TestRepackReplacesLooseObjectsAndPacks(t *testing.T) {
+	ctx := context.Background()
+	client, backend := greenfieldtest.NewBackend()
+	store := storage.NewObjectStorage(backend, "repo")
+
+	blobs, _ := similarBlobs(12)
+	var hashes []string
+	for hash := range blobs {
+		hashes = append(hashes, hash)
+	}
+
+	// Half of the objects go into a pack, the other half are loose
+	if _, err := store.StorePack(ctx, hashes[:6], blobLoader(blobs), storage.PackOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, hash := range hashes[6:] {
+		if _, err := store.Store(ctx, hash, storage.BlobObject, blobs[hash]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A window of two is enough for the sorted, similar blobs
+	packed, err := store.Repack(ctx, storage.PackOptions{Window: 2, Depth: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if packed != len(blobs) {
+		t.Errorf("repacked %d objects, want %d", packed, len(blobs))
+	}
+
+	// Only the new pack and its index are left
+	objects := client.Objects(greenfieldtest.Bucket)
+	if len(objects) != 2 {
+		t.Fatalf("bucket holds %q, want a pack and its index", objects)
+	}
+	fresh := storage.NewObjectStorage(backend, "repo")
+	for hash, data := range blobs {
+		if _, got, err := fresh.Get(ctx, hash); err != nil || !bytes.Equal(got, data) {
+			t.Errorf("object %s: got %d bytes, %v; want %d bytes", hash, len(got), err, len(data))
+		}
+	}
+}
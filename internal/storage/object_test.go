@@ -0,0 +1,108 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/mindkit-xyz/mindkit-gitk/internal/storage"
+	"github.com/mindkit-xyz/mindkit-gitk/internal/storage/greenfieldtest"
+)
+
+func TestStoreSkipsObjectStoredConcurrently(t *testing.T) {
+	ctx := context.Background()
+	client, backend := greenfieldtest.NewBackend()
+	data := []byte("content\n")
+	hash := storage.HashObject(storage.BlobObject, data)
+
+	if uploaded, err := storage.NewObjectStorage(backend, "repo").Store(ctx, hash, storage.BlobObject, data); err != nil || !uploaded {
+		t.Fatalf("Store = %v, %v; want the object uploaded", uploaded, err)
+	}
+
+	// Another push stores the object between the check and the upload of
+	// this one
+	client.FailNext("HeadObject", errors.New("No such object"))
+	uploads := client.Calls("PutObject")
+	uploaded, err := storage.NewObjectStorage(backend, "repo").Store(ctx, hash, storage.BlobObject, data)
+	if err != nil || uploaded {
+		t.Fatalf("Store = %v, %v; want the object skipped", uploaded, err)
+	}
+	if got := client.Calls("PutObject") - uploads; got != 0 {
+		t.Errorf("Store uploaded %d times", got)
+	}
+	if got := client.Calls("DeleteObject"); got != 0 {
+		t.Errorf("Store deleted %d objects", got)
+	}
+}
+
+func TestStoreRecreatesUnsealedObject(t *testing.T) {
+	ctx := context.Background()
+	client, backend := greenfieldtest.NewBackend()
+	store := storage.NewObjectStorage(backend, "repo")
+	data := []byte("content\n")
+	hash := storage.HashObject(storage.BlobObject, data)
+
+	// The object is created but its upload fails, leaving it unsealed
+	client.FailNext("PutObject", greenfieldtest.ErrServiceUnavailable)
+	if _, err := store.Store(ctx, hash, storage.BlobObject, data); err == nil {
+		t.Fatal("interrupted Store succeeded")
+	}
+
+	if uploaded, err := store.Store(ctx, hash, storage.BlobObject, data); err != nil || !uploaded {
+		t.Fatalf("Store = %v, %v; want the object uploaded", uploaded, err)
+	}
+	if _, got, err := store.Get(ctx, hash); err != nil || string(got) != string(data) {
+		t.Fatalf("Get = %q, %v; want %q", got, err, data)
+	}
+}
+
+// failingPutBackend fails PutFrom once the object content is being read
+type failingPutBackend struct {
+	storage.Backend
+	reading chan struct{}
+}
+
+func (b failingPutBackend) PutFrom(ctx context.Context, key string, r io.Reader) error {
+	go io.Copy(io.Discard, r)
+	<-b.reading
+	return errors.New("upload refused")
+}
+
+// blockingReader blocks its first Read until release is closed
+type blockingReader struct {
+	reading chan struct{}
+	release chan struct{}
+}
+
+func (r *blockingReader) Read(p []byte) (int, error) {
+	close(r.reading)
+	<-r.release
+	return 0, io.EOF
+}
+
+func TestStoreFromReturnsOnceDoneReading(t *testing.T) {
+	ctx := context.Background()
+	r := &blockingReader{reading: make(chan struct{}), release: make(chan struct{})}
+	backend := failingPutBackend{Backend: storage.NewLocalBackend(t.TempDir()), reading: r.reading}
+	store := storage.NewObjectStorage(backend, "repo")
+
+	returned := make(chan error)
+	go func() {
+		_, err := store.StoreFrom(ctx, storage.HashObject(storage.BlobObject, []byte("x")), storage.BlobObject, 1, r)
+		returned <- err
+	}()
+
+	// The upload fails while r is still being read
+	select {
+	case err := <-returned:
+		t.Fatalf("StoreFrom returned %v while its reader was in use", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(r.release)
+	if err := <-returned; err == nil {
+		t.Fatal("StoreFrom succeeded")
+	}
+}
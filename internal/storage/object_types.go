@@ -1,21 +1,43 @@
 package storage
 
 import (
+	"bufio"
 	"bytes"
+	"compress/zlib"
 	"crypto/sha1"
 	"encoding/hex"
 	"fmt"
+	"hash"
 	"io"
+	"strconv"
+	"strings"
 )
 
 // GitObject represents a Git object (blob, tree, commit, or tag)
 type GitObject interface {
 	Type() string
-	Serialize() []byte
+	Serialize() ([]byte, error)
 }
 
-// calculateHash calculates the SHA-1 hash of a Git object
-func calculateHash(objType string, data []byte) string {
+// ParseObject parses the content of a Git object of the given type
+func ParseObject(objType string, data []byte) (GitObject, error) {
+	switch objType {
+	case BlobObject:
+		return ParseBlob(data)
+	case TreeObject:
+		return ParseTree(data)
+	case CommitObject:
+		return ParseCommit(data)
+	case TagObject:
+		return ParseTag(data)
+	default:
+		return nil, fmt.Errorf("unknown object type %q", objType)
+	}
+}
+
+// HashObject calculates the SHA-1 object ID of a Git object, as
+// `git hash-object -t <type>` would
+func HashObject(objType string, data []byte) string {
 	h := sha1.New()
 	content := fmt.Sprintf("%s %d\x00", objType, len(data))
 	h.Write([]byte(content))
@@ -32,7 +54,7 @@ type ObjectReader struct {
 
 // NewObjectReader creates a new ObjectReader
 func NewObjectReader(objType string, data []byte) *ObjectReader {
-	hash := calculateHash(objType, data)
+	hash := HashObject(objType, data)
 	size := int64(len(data))
 	
 	header := fmt.Sprintf("%s %d\x00", objType, size)
@@ -55,40 +77,189 @@ func (r *ObjectReader) Size() int64 {
 	return r.size
 }
 
-// ObjectWriter provides an io.Writer interface for Git objects
+// ObjectWriter computes the hash of a Git object as its content is
+// written, and optionally writes the object in loose object format to an
+// underlying writer, compressing it on the way. The content is never held
+// in memory, so objects of any size can be written.
 type ObjectWriter struct {
-	buf    *bytes.Buffer
-	objType string
-	hash   string
+	hash    hash.Hash
+	zw      *zlib.Writer
+	size    int64
+	written int64
+	sum     string
 }
 
-// NewObjectWriter creates a new ObjectWriter
-func NewObjectWriter(objType string) *ObjectWriter {
-	return &ObjectWriter{
-		buf:     bytes.NewBuffer(nil),
-		objType: objType,
+// NewObjectWriter creates a writer for the content of an object of objType
+// and size bytes. If w is nil, the object is only hashed.
+func NewObjectWriter(w io.Writer, objType string, size int64) (*ObjectWriter, error) {
+	header := []byte(fmt.Sprintf("%s %d\x00", objType, size))
+
+	ow := &ObjectWriter{hash: sha1.New(), size: size}
+	ow.hash.Write(header)
+	if w != nil {
+		ow.zw = zlib.NewWriter(w)
+		if _, err := ow.zw.Write(header); err != nil {
+			return nil, fmt.Errorf("failed to compress object: %w", err)
+		}
 	}
+
+	return ow, nil
 }
 
 func (w *ObjectWriter) Write(p []byte) (int, error) {
-	return w.buf.Write(p)
+	if w.written+int64(len(p)) > w.size {
+		return 0, fmt.Errorf("object content exceeds its size of %d bytes", w.size)
+	}
+
+	w.hash.Write(p)
+	if w.zw != nil {
+		if n, err := w.zw.Write(p); err != nil {
+			w.written += int64(n)
+			return n, fmt.Errorf("failed to compress object: %w", err)
+		}
+	}
+	w.written += int64(len(p))
+
+	return len(p), nil
 }
 
-// Close finalizes the object and calculates its hash
+// Close checks that the whole content was written, flushes the compressed
+// object and calculates its hash
 func (w *ObjectWriter) Close() error {
-	data := w.buf.Bytes()
-	w.hash = calculateHash(w.objType, data)
+	if w.written != w.size {
+		return fmt.Errorf("object content is %d bytes, expected %d", w.written, w.size)
+	}
+	if w.zw != nil {
+		if err := w.zw.Close(); err != nil {
+			return fmt.Errorf("failed to compress object: %w", err)
+		}
+	}
+
+	w.sum = hex.EncodeToString(w.hash.Sum(nil))
 	return nil
 }
 
-// Hash returns the object's hash
+// Hash returns the object's hash, once the writer is closed
 func (w *ObjectWriter) Hash() string {
-	return w.hash
+	return w.sum
 }
 
-// Bytes returns the object's content
-func (w *ObjectWriter) Bytes() []byte {
-	return w.buf.Bytes()
+// HashObjectFrom calculates the object ID of a Git object of objType whose
+// size bytes of content are read from r
+func HashObjectFrom(objType string, size int64, r io.Reader) (string, error) {
+	w, err := NewObjectWriter(nil, objType, size)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return w.Hash(), nil
+}
+
+// EncodeLooseObject returns the Git loose object representation of an object:
+// the "type size\0" header followed by the content, zlib-deflated
+func EncodeLooseObject(objType string, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := NewObjectWriter(&buf, objType, int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DecodeLooseObject parses a Git loose object and returns its type and content
+func DecodeLooseObject(raw []byte) (string, []byte, error) {
+	zr, err := zlib.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to decompress object: %w", err)
+	}
+	defer zr.Close()
+
+	content, err := io.ReadAll(zr)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to decompress object: %w", err)
+	}
+
+	nul := bytes.IndexByte(content, 0)
+	if nul < 0 {
+		return "", nil, fmt.Errorf("invalid object header")
+	}
+	objType, sizeStr, ok := bytes.Cut(content[:nul], []byte(" "))
+	if !ok {
+		return "", nil, fmt.Errorf("invalid object header %q", content[:nul])
+	}
+	if !isObjectType(string(objType)) {
+		return "", nil, fmt.Errorf("unknown object type %q", objType)
+	}
+	size, err := strconv.ParseInt(string(sizeStr), 10, 64)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid object size %q", sizeStr)
+	}
+
+	data := content[nul+1:]
+	if int64(len(data)) != size {
+		return "", nil, fmt.Errorf("object size mismatch: header says %d, got %d", size, len(data))
+	}
+
+	return string(objType), data, nil
+}
+
+// OpenLooseObject reads the header of a Git loose object from r and returns
+// the object's type and size along with a reader of its content, which is
+// decompressed as it is read
+func OpenLooseObject(r io.Reader) (string, int64, io.ReadCloser, error) {
+	zr, err := zlib.NewReader(r)
+	if err != nil {
+		return "", 0, nil, fmt.Errorf("failed to decompress object: %w", err)
+	}
+
+	br := bufio.NewReader(zr)
+	header, err := br.ReadString(0)
+	if err != nil {
+		zr.Close()
+		return "", 0, nil, fmt.Errorf("invalid object header: %w", err)
+	}
+	objType, sizeStr, ok := strings.Cut(strings.TrimSuffix(header, "\x00"), " ")
+	if !ok || !isObjectType(objType) {
+		zr.Close()
+		return "", 0, nil, fmt.Errorf("invalid object header %q", header)
+	}
+	size, err := strconv.ParseInt(sizeStr, 10, 64)
+	if err != nil || size < 0 {
+		zr.Close()
+		return "", 0, nil, fmt.Errorf("invalid object size %q", sizeStr)
+	}
+
+	return objType, size, &looseObjectReader{Reader: io.LimitReader(br, size), zr: zr}, nil
+}
+
+// looseObjectReader reads the content of a loose object
+type looseObjectReader struct {
+	io.Reader
+	zr io.ReadCloser
+}
+
+func (r *looseObjectReader) Close() error {
+	return r.zr.Close()
+}
+
+// isObjectType reports whether objType is one of the Git object types
+func isObjectType(objType string) bool {
+	switch objType {
+	case BlobObject, TreeObject, CommitObject, TagObject:
+		return true
+	}
+	return false
 }
 
 // Common Git object types
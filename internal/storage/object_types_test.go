@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"bytes"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+)
+
+// testdata/objects holds loose objects written by git: commits with a
+// gpgsig and an encoding header, a merge, trees with executable, symlink and
+// submodule entries, and annotated tags, signed, nested, pointing at a tree,
+// without a tagger and with a gpgsig-sha256 header
+const testObjects = "testdata/objects"
+
+// gitObjects returns the objects in testdata/objects by hash
+func gitObjects(t *testing.T) map[string][]byte {
+	t.Helper()
+
+	objects := make(map[string][]byte)
+	err := filepath.WalkDir(testObjects, func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		raw, err := os.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		dir, file := path.Split(filepath.ToSlash(name))
+		objects[path.Base(dir)+file] = raw
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) == 0 {
+		t.Fatal("no objects in " + testObjects)
+	}
+	return objects
+}
+
+func TestParseObjectRoundTripsGitObjects(t *testing.T) {
+	types := make(map[string]int)
+	for hash, raw := range gitObjects(t) {
+		objType, data, err := DecodeLooseObject(raw)
+		if err != nil {
+			t.Fatalf("%s: %v", hash, err)
+		}
+		types[objType]++
+
+		if got := HashObject(objType, data); got != hash {
+			t.Errorf("%s: %s hashes to %s", hash, objType, got)
+		}
+
+		obj, err := ParseObject(objType, data)
+		if err != nil {
+			t.Errorf("%s: failed to parse %s: %v", hash, objType, err)
+			continue
+		}
+		serialized, err := obj.Serialize()
+		if err != nil {
+			t.Errorf("%s: failed to serialize %s: %v", hash, objType, err)
+			continue
+		}
+		if !bytes.Equal(serialized, data) {
+			t.Errorf("%s: %s does not round-trip:\n got: %q\nwant: %q", hash, objType, serialized, data)
+		}
+		if got := HashObject(obj.Type(), serialized); got != hash {
+			t.Errorf("%s: serialized %s hashes to %s", hash, objType, got)
+		}
+	}
+
+	for _, objType := range []string{BlobObject, TreeObject, CommitObject, TagObject} {
+		if types[objType] == 0 {
+			t.Errorf("no %s in %s", objType, testObjects)
+		}
+	}
+}
+
+func TestParseGitObjects(t *testing.T) {
+	objects := gitObjects(t)
+	parse := func(hash string) GitObject {
+		t.Helper()
+		objType, data, err := DecodeLooseObject(objects[hash])
+		if err != nil {
+			t.Fatal(err)
+		}
+		obj, err := ParseObject(objType, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return obj
+	}
+
+	signed := parse("bda62281b77b2b9029266f278a2b14b8fc00cbd3").(*Commit)
+	if len(signed.ExtraHeaders) != 1 || signed.ExtraHeaders[0].Key != "gpgsig" {
+		t.Errorf("signed commit has extra headers %q, want gpgsig", signed.ExtraHeaders)
+	}
+
+	merge := parse("3cdd1afafa8ad0f575fe855a335d86748f95ec9a").(*Commit)
+	if len(merge.Parents) != 2 {
+		t.Errorf("merge has %d parents, want 2", len(merge.Parents))
+	}
+
+	modes := make(map[FileMode]bool)
+	for _, hash := range []string{"99e888965ce875559745b07db436de7722104e3a", "83d344c06fcf9e97c7fb7cb36a11ba0d340939c4"} {
+		for _, entry := range parse(hash).(*Tree).Entries {
+			modes[entry.Mode] = true
+		}
+	}
+	for _, mode := range []FileMode{ModeBlob, ModeExecutable, ModeSymlink, ModeSubmodule, ModeTree} {
+		if !modes[mode] {
+			t.Errorf("no tree entry with mode %s", mode)
+		}
+	}
+
+	sha256Signed := parse("f8e91128d11c0671b0c12ca1db600c094b4f3387").(*Tag)
+	if len(sha256Signed.ExtraHeaders) != 1 || sha256Signed.ExtraHeaders[0].Key != "gpgsig-sha256" {
+		t.Errorf("tag has extra headers %q, want gpgsig-sha256", sha256Signed.ExtraHeaders)
+	}
+
+	untagged := parse("8cc1e7ce77af63de52dd8c9cc56256235c266a9b").(*Tag)
+	if untagged.Tagger != nil {
+		t.Errorf("tag without tagger parsed with tagger %v", untagged.Tagger)
+	}
+}
+
+func TestTreeSerializeRejectsInvalidHash(t *testing.T) {
+	valid := HashObject(BlobObject, []byte("a\n"))
+	for _, hash := range []string{"not hex", valid[:38], valid + "00"} {
+		tree := &Tree{Entries: []TreeEntry{{Mode: ModeBlob, Name: "a.txt", Hash: hash}}}
+		if _, err := tree.Serialize(); err == nil {
+			t.Errorf("tree with entry hash %q serialized", hash)
+		}
+	}
+}
@@ -0,0 +1,545 @@
+package storage
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"sort"
+)
+
+// Object type numbers used in packfiles
+const (
+	packCommit   = 1
+	packTree     = 2
+	packBlob     = 3
+	packTag      = 4
+	packOfsDelta = 6
+	packRefDelta = 7
+)
+
+const (
+	packSignature    = "PACK"
+	packVersion      = 2
+	packIndexVersion = 2
+)
+
+// packIndexMagic starts a version 2 or later pack index
+var packIndexMagic = []byte{0xff, 't', 'O', 'c'}
+
+var packTypeNumbers = map[string]byte{
+	CommitObject: packCommit,
+	TreeObject:   packTree,
+	BlobObject:   packBlob,
+	TagObject:    packTag,
+}
+
+var packTypeNames = map[byte]string{
+	packCommit: CommitObject,
+	packTree:   TreeObject,
+	packBlob:   BlobObject,
+	packTag:    TagObject,
+}
+
+// PackObject is an object to be written to a packfile
+type PackObject struct {
+	Hash string
+	Type string
+	Data []byte
+}
+
+// packIndexEntry locates an object in a packfile
+type packIndexEntry struct {
+	hash   []byte
+	offset int64
+	crc    uint32
+}
+
+// packObjectInfo describes an object to be written to a packfile
+type packObjectInfo struct {
+	hash    string
+	objType string
+	size    int64
+}
+
+// sortPackObjects orders objects as git does to find delta bases: by type,
+// then by decreasing size, so that each object is compared with the
+// similar objects just before it
+func sortPackObjects(objects []packObjectInfo) {
+	sort.SliceStable(objects, func(a, b int) bool {
+		x, y := objects[a], objects[b]
+		if x.objType != y.objType {
+			return packTypeNumbers[x.objType] < packTypeNumbers[y.objType]
+		}
+		return x.size > y.size
+	})
+}
+
+// packWriter writes a version 2 packfile to an io.Writer one object at a
+// time, and collects the entries of its index. Objects are stored as deltas
+// against the objects written just before them as configured by opts, so
+// that only the opts.Window last objects are held in memory.
+type packWriter struct {
+	w      io.Writer
+	sum    hash.Hash
+	offset int64
+	opts   PackOptions
+
+	window  []packWindowEntry
+	entries []packIndexEntry
+	// entry holds the entry being written
+	entry bytes.Buffer
+}
+
+// packWindowEntry is an object written recently, a candidate delta base
+type packWindowEntry struct {
+	objType string
+	data    []byte
+	offset  int64
+	depth   int
+	// index is built the first time the entry is tried as a base
+	index *deltaIndex
+}
+
+// deltaBaseFor reports whether obj is worth trying as a delta of the entry.
+// Bases of less than half the size of obj are skipped, since the delta
+// would have to insert more than half of obj and could not be kept.
+func (e *packWindowEntry) deltaBaseFor(obj PackObject, maxDepth int) bool {
+	return e.objType == obj.Type && e.depth < maxDepth &&
+		len(e.data) >= minDeltaSize && len(e.data) >= len(obj.Data)/2
+}
+
+// deltaIndex returns the index of the entry's data, building it once
+func (e *packWindowEntry) deltaIndex() *deltaIndex {
+	if e.index == nil {
+		e.index = newDeltaIndex(e.data)
+	}
+	return e.index
+}
+
+// newPackWriter starts a packfile of count objects on w
+func newPackWriter(w io.Writer, count int, opts PackOptions) (*packWriter, error) {
+	pw := &packWriter{sum: sha1.New(), opts: opts}
+	pw.w = io.MultiWriter(w, pw.sum)
+
+	var header bytes.Buffer
+	header.WriteString(packSignature)
+	binary.Write(&header, binary.BigEndian, uint32(packVersion))
+	binary.Write(&header, binary.BigEndian, uint32(count))
+	if _, err := pw.w.Write(header.Bytes()); err != nil {
+		return nil, err
+	}
+	pw.offset = int64(header.Len())
+
+	return pw, nil
+}
+
+// write adds obj to the pack. Like git, it tries obj against each object of
+// the window and keeps the smallest delta if it saves at least half of the
+// object. Objects smaller than minDeltaSize are not tried.
+func (pw *packWriter) write(obj PackObject) error {
+	typeNum, ok := packTypeNumbers[obj.Type]
+	if !ok {
+		return fmt.Errorf("invalid object type %q", obj.Type)
+	}
+	hash, err := hex.DecodeString(obj.Hash)
+	if err != nil || len(hash) != sha1.Size {
+		return fmt.Errorf("invalid object hash %q", obj.Hash)
+	}
+
+	var base *packWindowEntry
+	var delta []byte
+	if len(obj.Data) >= minDeltaSize {
+		for i := range pw.window {
+			candidate := &pw.window[i]
+			if !candidate.deltaBaseFor(obj, pw.opts.Depth) {
+				continue
+			}
+
+			d := candidate.deltaIndex().encode(obj.Data)
+			if len(d) < len(obj.Data)/2 && (delta == nil || len(d) < len(delta)) {
+				base, delta = candidate, d
+			}
+		}
+	}
+
+	// OFS_DELTA can only point back, which the window guarantees
+	pw.entry.Reset()
+	depth := 0
+	if base != nil {
+		err = writePackDelta(&pw.entry, pw.offset-base.offset, delta)
+		depth = base.depth + 1
+	} else {
+		err = writePackEntry(&pw.entry, typeNum, obj.Data)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := pw.w.Write(pw.entry.Bytes()); err != nil {
+		return err
+	}
+
+	pw.entries = append(pw.entries, packIndexEntry{
+		hash:   hash,
+		offset: pw.offset,
+		crc:    crc32.ChecksumIEEE(pw.entry.Bytes()),
+	})
+	if pw.opts.Window > 0 && pw.opts.Depth > 0 {
+		if len(pw.window) == pw.opts.Window {
+			pw.window = append(pw.window[:0], pw.window[1:]...)
+		}
+		pw.window = append(pw.window, packWindowEntry{objType: obj.Type, data: obj.Data, offset: pw.offset, depth: depth})
+	}
+	pw.offset += int64(pw.entry.Len())
+
+	return nil
+}
+
+// close ends the pack with its checksum and returns its index in version 2
+// format and the checksum, which names both
+func (pw *packWriter) close() ([]byte, string, error) {
+	checksum := pw.sum.Sum(nil)
+	if _, err := pw.w.Write(checksum); err != nil {
+		return nil, "", err
+	}
+	pw.offset += int64(len(checksum))
+	pw.window = nil
+
+	return encodePackIndex(pw.entries, checksum), hex.EncodeToString(checksum), nil
+}
+
+// writePackEntry writes an object header followed by the compressed data
+func writePackEntry(w *bytes.Buffer, typeNum byte, data []byte) error {
+	writePackEntryHeader(w, typeNum, len(data))
+	return writeCompressed(w, data)
+}
+
+// writePackDelta writes an OFS_DELTA entry for delta, whose base starts
+// distance bytes before it
+func writePackDelta(w *bytes.Buffer, distance int64, delta []byte) error {
+	writePackEntryHeader(w, packOfsDelta, len(delta))
+
+	// Big-endian seven bits per byte, where each continuation also adds one
+	// so that every distance has a single encoding
+	var buf [10]byte
+	pos := len(buf) - 1
+	buf[pos] = byte(distance & 0x7f)
+	for distance >>= 7; distance != 0; distance >>= 7 {
+		distance--
+		pos--
+		buf[pos] = byte(distance&0x7f) | 0x80
+	}
+	w.Write(buf[pos:])
+
+	return writeCompressed(w, delta)
+}
+
+// writePackEntryHeader writes the type and size of a pack entry
+func writePackEntryHeader(w *bytes.Buffer, typeNum byte, length int) {
+	// The first byte holds the type and the low four bits of the size,
+	// following bytes seven more bits each
+	size := uint64(length)
+	b := typeNum<<4 | byte(size&0x0f)
+	size >>= 4
+	for size != 0 {
+		w.WriteByte(b | 0x80)
+		b = byte(size & 0x7f)
+		size >>= 7
+	}
+	w.WriteByte(b)
+}
+
+// writeCompressed writes data compressed with zlib
+func writeCompressed(w *bytes.Buffer, data []byte) error {
+	zw := zlib.NewWriter(w)
+	if _, err := zw.Write(data); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// encodePackIndex writes a version 2 pack index for entries
+func encodePackIndex(entries []packIndexEntry, packChecksum []byte) []byte {
+	sort.Slice(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i].hash, entries[j].hash) < 0
+	})
+
+	var idx bytes.Buffer
+	idx.Write(packIndexMagic)
+	binary.Write(&idx, binary.BigEndian, uint32(packIndexVersion))
+
+	// Fan-out table: the number of objects whose first byte is at most i
+	var fanout [256]uint32
+	for _, entry := range entries {
+		fanout[entry.hash[0]]++
+	}
+	for i := 1; i < len(fanout); i++ {
+		fanout[i] += fanout[i-1]
+	}
+	binary.Write(&idx, binary.BigEndian, fanout)
+
+	for _, entry := range entries {
+		idx.Write(entry.hash)
+	}
+	for _, entry := range entries {
+		binary.Write(&idx, binary.BigEndian, entry.crc)
+	}
+
+	// Offsets that do not fit in 31 bits go to a table of 64-bit offsets
+	var large []uint64
+	for _, entry := range entries {
+		if entry.offset < 1<<31 {
+			binary.Write(&idx, binary.BigEndian, uint32(entry.offset))
+			continue
+		}
+		binary.Write(&idx, binary.BigEndian, uint32(len(large))|1<<31)
+		large = append(large, uint64(entry.offset))
+	}
+	binary.Write(&idx, binary.BigEndian, large)
+
+	idx.Write(packChecksum)
+	checksum := sha1.Sum(idx.Bytes())
+	idx.Write(checksum[:])
+
+	return idx.Bytes()
+}
+
+// packIndex is a parsed pack index
+type packIndex struct {
+	fanout  [256]uint32
+	hashes  []byte
+	offsets []int64
+	// sorted holds the offsets in pack order, to tell where entries end
+	sorted []int64
+}
+
+// parsePackIndex parses a version 2 pack index
+func parsePackIndex(data []byte) (*packIndex, error) {
+	const headerLen = 8 + 256*4
+	if len(data) < headerLen+2*sha1.Size || !bytes.Equal(data[:4], packIndexMagic) {
+		return nil, errors.New("invalid pack index")
+	}
+	if version := binary.BigEndian.Uint32(data[4:8]); version != packIndexVersion {
+		return nil, fmt.Errorf("unsupported pack index version %d", version)
+	}
+
+	idx := &packIndex{}
+	for i := range idx.fanout {
+		idx.fanout[i] = binary.BigEndian.Uint32(data[8+i*4:])
+	}
+	count := int(idx.fanout[255])
+
+	hashesStart := headerLen
+	crcStart := hashesStart + count*sha1.Size
+	offsetsStart := crcStart + count*4
+	largeStart := offsetsStart + count*4
+	if len(data) < largeStart+2*sha1.Size {
+		return nil, errors.New("truncated pack index")
+	}
+
+	checksum := sha1.Sum(data[:len(data)-sha1.Size])
+	if !bytes.Equal(checksum[:], data[len(data)-sha1.Size:]) {
+		return nil, errors.New("pack index checksum mismatch")
+	}
+
+	idx.hashes = data[hashesStart:crcStart]
+	idx.offsets = make([]int64, count)
+	for i := range idx.offsets {
+		offset := binary.BigEndian.Uint32(data[offsetsStart+i*4:])
+		if offset&(1<<31) == 0 {
+			idx.offsets[i] = int64(offset)
+			continue
+		}
+
+		pos := largeStart + int(offset&^(1<<31))*8
+		if pos+8 > len(data)-2*sha1.Size {
+			return nil, errors.New("invalid pack index offset")
+		}
+		idx.offsets[i] = int64(binary.BigEndian.Uint64(data[pos:]))
+	}
+
+	idx.sorted = append([]int64(nil), idx.offsets...)
+	sort.Slice(idx.sorted, func(i, j int) bool { return idx.sorted[i] < idx.sorted[j] })
+
+	return idx, nil
+}
+
+// count returns the number of objects in the pack
+func (idx *packIndex) count() int {
+	return len(idx.offsets)
+}
+
+// hash returns the hash of the i-th object in hash order
+func (idx *packIndex) hash(i int) string {
+	return hex.EncodeToString(idx.hashes[i*sha1.Size : (i+1)*sha1.Size])
+}
+
+// entryEnd returns the offset where the entry at offset ends in a pack of
+// packSize bytes: the start of the next entry, or of the trailing checksum
+func (idx *packIndex) entryEnd(offset, packSize int64) int64 {
+	i := sort.Search(len(idx.sorted), func(i int) bool { return idx.sorted[i] > offset })
+	if i < len(idx.sorted) {
+		return idx.sorted[i]
+	}
+	return packSize - sha1.Size
+}
+
+// find returns the pack offset of the object hash
+func (idx *packIndex) find(hash string) (int64, bool) {
+	raw, err := hex.DecodeString(hash)
+	if err != nil || len(raw) != sha1.Size {
+		return 0, false
+	}
+
+	// The fan-out table narrows the search to hashes with the same first byte
+	lo := 0
+	if raw[0] > 0 {
+		lo = int(idx.fanout[raw[0]-1])
+	}
+	hi := int(idx.fanout[raw[0]])
+
+	i := lo + sort.Search(hi-lo, func(i int) bool {
+		return bytes.Compare(idx.hashes[(lo+i)*sha1.Size:(lo+i+1)*sha1.Size], raw) >= 0
+	})
+	if i < hi && bytes.Equal(idx.hashes[i*sha1.Size:(i+1)*sha1.Size], raw) {
+		return idx.offsets[i], true
+	}
+
+	return 0, false
+}
+
+// packEntry is an entry of a packfile: an object, or a delta with the
+// location of its base
+type packEntry struct {
+	typeNum byte
+	// size is the size of the object or delta once inflated
+	size uint64
+	// baseOffset locates the base of an OFS_DELTA in the pack
+	baseOffset int64
+	// baseHash names the base of a REF_DELTA
+	baseHash string
+	// data is the compressed content, possibly followed by more bytes
+	data []byte
+}
+
+// isDelta reports whether the entry is a delta
+func (e *packEntry) isDelta() bool {
+	return e.typeNum == packOfsDelta || e.typeNum == packRefDelta
+}
+
+// parsePackEntry parses the entry at offset of a pack, whose bytes start raw
+func parsePackEntry(raw []byte, offset int64) (*packEntry, error) {
+	typeNum, size, n, err := parsePackEntryHeader(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pack entry at offset %d: %w", offset, err)
+	}
+	entry := &packEntry{typeNum: typeNum, size: size}
+	raw = raw[n:]
+
+	switch typeNum {
+	case packCommit, packTree, packBlob, packTag:
+		// The compressed content follows the header
+
+	case packOfsDelta:
+		distance, n, err := parseDeltaDistance(raw)
+		if err != nil || distance <= 0 || distance > offset-12 {
+			return nil, fmt.Errorf("invalid delta base offset at offset %d", offset)
+		}
+		entry.baseOffset = offset - distance
+		raw = raw[n:]
+
+	case packRefDelta:
+		if len(raw) < sha1.Size {
+			return nil, fmt.Errorf("invalid pack entry at offset %d: %w", offset, io.ErrUnexpectedEOF)
+		}
+		entry.baseHash = hex.EncodeToString(raw[:sha1.Size])
+		raw = raw[sha1.Size:]
+
+	default:
+		return nil, fmt.Errorf("invalid pack object type %d at offset %d", typeNum, offset)
+	}
+
+	entry.data = raw
+	return entry, nil
+}
+
+// inflate returns the object or delta of the entry
+func (e *packEntry) inflate() ([]byte, error) {
+	return inflate(e.data, e.size)
+}
+
+// parseDeltaDistance parses the distance from an OFS_DELTA entry back to
+// its base and returns it with its length
+func parseDeltaDistance(data []byte) (int64, int, error) {
+	var distance int64
+	for i, b := range data {
+		if i > 8 {
+			break
+		}
+		if i > 0 {
+			distance++
+		}
+		distance = distance<<7 | int64(b&0x7f)
+		if b&0x80 == 0 {
+			return distance, i + 1, nil
+		}
+	}
+	return 0, 0, errors.New("invalid delta base offset")
+}
+
+// parsePackEntryHeader parses the type and size at the start of a pack
+// entry and returns them with the length of the header
+func parsePackEntryHeader(data []byte) (byte, uint64, int, error) {
+	if len(data) == 0 {
+		return 0, 0, 0, io.ErrUnexpectedEOF
+	}
+
+	b := data[0]
+	typeNum := (b >> 4) & 0x07
+	size := uint64(b & 0x0f)
+	shift := 4
+	n := 1
+	for b&0x80 != 0 {
+		if n >= len(data) || shift > 57 {
+			return 0, 0, 0, errors.New("invalid pack entry header")
+		}
+		b = data[n]
+		size |= uint64(b&0x7f) << shift
+		shift += 7
+		n++
+	}
+
+	return typeNum, size, n, nil
+}
+
+// maxInflateRatio bounds how much larger than its compressed form deflated
+// data can be: a little over 1032 to 1
+const maxInflateRatio = 1032
+
+// inflate decompresses size bytes of zlib data from the start of data
+func inflate(data []byte, size uint64) ([]byte, error) {
+	// size comes from the pack, so it is checked against what data can
+	// inflate to before anything is allocated for it
+	if size/maxInflateRatio > uint64(len(data)) {
+		return nil, fmt.Errorf("size %d is out of bounds for %d bytes of compressed data", size, len(data))
+	}
+
+	zr, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	out := make([]byte, size)
+	if _, err := io.ReadFull(zr, out); err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
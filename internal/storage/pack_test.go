@@ -0,0 +1,180 @@
+package storage
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInflateRejectsImpossibleSize(t *testing.T) {
+	var compressed bytes.Buffer
+	if err := writeCompressed(&compressed, []byte("content\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A corrupt pack entry header claiming an exabyte
+	if _, err := inflate(compressed.Bytes(), 1<<60); err == nil {
+		t.Fatal("inflated an exabyte out of a few bytes")
+	}
+	if data, err := inflate(compressed.Bytes(), 8); err != nil || string(data) != "content\n" {
+		t.Fatalf("inflate = %q, %v", data, err)
+	}
+
+	// Highly compressible data inflates within the bound
+	zeros := make([]byte, 1<<20)
+	compressed.Reset()
+	zw := zlib.NewWriter(&compressed)
+	zw.Write(zeros)
+	zw.Close()
+	if data, err := inflate(compressed.Bytes(), uint64(len(zeros))); err != nil || !bytes.Equal(data, zeros) {
+		t.Fatalf("inflate of %d zeros = %d bytes, %v", len(zeros), len(data), err)
+	}
+}
+
+func TestApplyDeltaRejectsImpossibleTargetSize(t *testing.T) {
+	base := []byte(strings.Repeat("base content\n", 10))
+	target := append(bytes.Clone(base), "more\n"...)
+	delta := encodeDelta(base, target)
+	if got, err := applyDelta(base, delta); err != nil || !bytes.Equal(got, target) {
+		t.Fatalf("applyDelta = %q, %v", got, err)
+	}
+
+	// The same instructions with a header claiming an exabyte target
+	var forged bytes.Buffer
+	writeDeltaSize(&forged, len(base))
+	writeDeltaSize(&forged, 1<<60)
+	_, n := readDeltaSize(delta)
+	_, m := readDeltaSize(delta[n:])
+	forged.Write(delta[n+m:])
+	if _, err := applyDelta(base, forged.Bytes()); !errors.Is(err, errInvalidDelta) {
+		t.Fatalf("applyDelta = %v, want errInvalidDelta", err)
+	}
+}
+
+// blockingBackend holds Get calls for pack indexes until release is closed
+type blockingBackend struct {
+	Backend
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingBackend) Get(ctx context.Context, key string) ([]byte, error) {
+	if strings.HasSuffix(key, ".idx") {
+		close(b.started)
+		<-b.release
+	}
+	return b.Backend.Get(ctx, key)
+}
+
+func TestLoadPacksDoesNotBlockLookups(t *testing.T) {
+	ctx := context.Background()
+	local := NewLocalBackend(t.TempDir())
+	data := []byte("packed\n")
+	hash := HashObject(BlobObject, data)
+	load := func(ctx context.Context, h string) (string, int64, io.ReadCloser, error) {
+		return BlobObject, int64(len(data)), io.NopCloser(bytes.NewReader(data)), nil
+	}
+	if _, err := NewObjectStorage(local, "").StorePack(ctx, []string{hash}, load, PackOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	backend := &blockingBackend{Backend: local, started: make(chan struct{}), release: make(chan struct{})}
+	store := NewObjectStorage(backend, "")
+	done := make(chan error)
+	go func() { done <- store.loadPacks(ctx, false) }()
+
+	// While the index is fetched, lookups answer from the packs loaded so far
+	<-backend.started
+	found := make(chan bool)
+	go func() { found <- store.findPacked(hash) != nil }()
+	select {
+	case ok := <-found:
+		if ok {
+			t.Error("found the object before its index was read")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("lookup waited for the index to be fetched")
+	}
+
+	close(backend.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if store.findPacked(hash) == nil {
+		t.Error("object not found once its index was read")
+	}
+}
+
+// packDepths writes objects to a pack and returns the delta depth of each
+func packDepths(t *testing.T, opts PackOptions, objects ...[]byte) ([]int, *packWriter) {
+	t.Helper()
+
+	pw, err := newPackWriter(io.Discard, len(objects), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var depths []int
+	for _, data := range objects {
+		if err := pw.write(PackObject{Hash: HashObject(BlobObject, data), Type: BlobObject, Data: data}); err != nil {
+			t.Fatal(err)
+		}
+		depths = append(depths, pw.window[len(pw.window)-1].depth)
+	}
+	return depths, pw
+}
+
+func TestPackWriterDeltifiesSimilarObjects(t *testing.T) {
+	base := []byte(strings.Repeat("line of the base object\n", 20))
+	first := append(bytes.Clone(base), "first\n"...)
+	second := append(bytes.Clone(base), "second\n"...)
+
+	depths, _ := packDepths(t, PackOptions{Window: 1, Depth: 1}, base, first)
+	if want := []int{0, 1}; !reflect.DeepEqual(depths, want) {
+		t.Errorf("depths = %v, want %v", depths, want)
+	}
+
+	// Each object is tried against the base, which is indexed once
+	depths, pw := packDepths(t, PackOptions{Window: 4, Depth: 1}, base, first, second)
+	if want := []int{0, 1, 1}; !reflect.DeepEqual(depths, want) {
+		t.Errorf("depths = %v, want %v", depths, want)
+	}
+	index := pw.window[0].index
+	if index == nil {
+		t.Fatal("base was not indexed")
+	}
+	third := append(bytes.Clone(base), "third\n"...)
+	if err := pw.write(PackObject{Hash: HashObject(BlobObject, third), Type: BlobObject, Data: third}); err != nil {
+		t.Fatal(err)
+	}
+	if pw.window[0].index != index {
+		t.Error("base was indexed again")
+	}
+}
+
+func TestPackWriterSkipsUnpromisingDeltas(t *testing.T) {
+	opts := PackOptions{Window: 10, Depth: 10}
+
+	// Small objects are stored whole however similar
+	small := []byte(strings.Repeat("x", minDeltaSize-2))
+	depths, pw := packDepths(t, opts, small, append(bytes.Clone(small), 'y'), append(bytes.Clone(small), 'z'))
+	if want := []int{0, 0, 0}; !reflect.DeepEqual(depths, want) {
+		t.Errorf("depths of small objects = %v, want %v", depths, want)
+	}
+
+	// A base under half the size of the object is not even indexed
+	base := []byte(strings.Repeat("line of the base object\n", 10))
+	large := bytes.Repeat(base, 3)
+	depths, pw = packDepths(t, opts, base, large)
+	if want := []int{0, 0}; !reflect.DeepEqual(depths, want) {
+		t.Errorf("depths = %v, want %v", depths, want)
+	}
+	if pw.window[0].index != nil {
+		t.Error("indexed a base too small for the object")
+	}
+}
@@ -0,0 +1,53 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// packedRefsName is the name of the object holding packed references
+const packedRefsName = "packed-refs"
+
+// packedRefsHeader starts a packed-refs file. Peeled values of annotated tags
+// are not recorded, so the "peeled" trait is not claimed.
+const packedRefsHeader = "# pack-refs with: sorted \n"
+
+// parsePackedRefs parses a file in Git's packed-refs format into a map from
+// reference name to hash. Peeled tag lines are skipped.
+func parsePackedRefs(data []byte) (map[string]string, error) {
+	refs := make(map[string]string)
+
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "^") {
+			continue
+		}
+
+		hash, name, ok := strings.Cut(line, " ")
+		if !ok || len(hash) != 40 || name == "" {
+			return nil, fmt.Errorf("malformed packed-refs line %q", line)
+		}
+		refs[name] = hash
+	}
+
+	return refs, nil
+}
+
+// encodePackedRefs serializes refs in Git's packed-refs format, sorted by name
+func encodePackedRefs(refs map[string]string) []byte {
+	names := make([]string, 0, len(refs))
+	for name := range refs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	buf.WriteString(packedRefsHeader)
+	for _, name := range names {
+		fmt.Fprintf(&buf, "%s %s\n", refs[name], name)
+	}
+
+	return buf.Bytes()
+}
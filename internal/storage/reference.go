@@ -2,119 +2,554 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io/fs"
 	"path"
+	"sort"
 	"strings"
-
-	gsdk "github.com/bnb-chain/greenfield-go-sdk/client"
-	"github.com/bnb-chain/greenfield-go-sdk/types"
+	"time"
 )
 
-// ReferenceStorage implements storage for Git references in BNB Greenfield
+// symrefPrefix starts the content of a symbolic reference
+const symrefPrefix = "ref: "
+
+// maxSymrefDepth limits how many symbolic references are followed, as in git
+const maxSymrefDepth = 5
+
+// lockOwnerPrefix starts the line of a lock that tells who took it and when
+const lockOwnerPrefix = "locked-by "
+
+// unlockTimeout bounds the release of a lock, which happens even when the
+// update holding it was canceled
+const unlockTimeout = 30 * time.Second
+
+// Reference is a Git reference. A direct reference holds the hash of an
+// object; a symbolic reference, such as HEAD, holds the name of another reference.
+type Reference struct {
+	Name   string
+	Hash   string
+	Target string
+}
+
+// IsSymbolic reports whether the reference names another reference
+func (r *Reference) IsSymbolic() bool {
+	return r.Target != ""
+}
+
+// Unborn reports whether a resolved reference does not exist yet, as is the
+// case for the current branch of a repository without commits
+func (r *Reference) Unborn() bool {
+	return r.Target == "" && r.Hash == ""
+}
+
+// RefConflictError is returned by CompareAndSetReference when a reference
+// no longer holds the value the caller based its update on
+type RefConflictError struct {
+	Name     string
+	Expected string
+	Actual   string
+}
+
+func (e *RefConflictError) Error() string {
+	describe := func(hash string) string {
+		if hash == "" {
+			return "nothing"
+		}
+		return hash
+	}
+	return fmt.Sprintf("reference %s changed concurrently: expected %s, found %s",
+		e.Name, describe(e.Expected), describe(e.Actual))
+}
+
+// ReferenceStorage implements storage for Git references on a storage backend.
+// Every update of a direct reference is recorded in its reflog.
 type ReferenceStorage struct {
-	client     *gsdk.GreenfieldClient
-	bucketName string
-	prefix     string
+	backend  Backend
+	prefix   string
+	identity Signature
 }
 
-// NewReferenceStorage creates a new reference storage instance
-func NewReferenceStorage(client *gsdk.GreenfieldClient, bucketName, prefix string) *ReferenceStorage {
+// NewReferenceStorage creates a new reference storage instance. identity
+// supplies the name and email recorded in reflog entries.
+func NewReferenceStorage(backend Backend, prefix string, identity Signature) *ReferenceStorage {
 	return &ReferenceStorage{
-		client:     client,
-		bucketName: bucketName,
-		prefix:     prefix,
+		backend:  backend,
+		prefix:   prefix,
+		identity: identity,
+	}
+}
+
+// SetReference points a Git reference at the object hash, logging the
+// update with message
+func (s *ReferenceStorage) SetReference(ctx context.Context, refName, hash, message string) (err error) {
+	unlock, err := s.lock(ctx, refName, hash)
+	if err != nil {
+		return err
+	}
+	defer release(unlock, &err)
+
+	var oldHash string
+	ref, err := s.ReadReference(ctx, refName)
+	switch {
+	case errors.Is(err, ErrRefNotFound):
+	case err != nil:
+		return err
+	case !ref.IsSymbolic():
+		oldHash = ref.Hash
 	}
+
+	return s.setReference(ctx, refName, oldHash, hash, message)
+}
+
+func (s *ReferenceStorage) setReference(ctx context.Context, refName, oldHash, newHash, message string) error {
+	if err := s.writeReference(ctx, refName, newHash+"\n"); err != nil {
+		return err
+	}
+
+	return s.logUpdate(ctx, refName, oldHash, newHash, message)
 }
 
-// SetReference stores a Git reference in BNB Greenfield
-func (s *ReferenceStorage) SetReference(ctx context.Context, refName, hash string) error {
-	refPath := path.Join(s.prefix, "refs", refName)
-	
-	createObjectTx, err := s.client.CreateObject(
-		ctx,
-		s.bucketName,
-		refPath,
-		types.CreateObjectOptions{},
-	)
+// CompareAndSetReference points refName at newHash, provided it still
+// points at expectedOld. An empty expectedOld means the reference must not
+// exist yet. If the reference holds another value, the returned error is a
+// *RefConflictError and nothing is written. The update is logged with message.
+func (s *ReferenceStorage) CompareAndSetReference(ctx context.Context, refName, newHash, expectedOld, message string) (err error) {
+	unlock, err := s.lock(ctx, refName, newHash)
 	if err != nil {
-		return fmt.Errorf("failed to create reference: %w", err)
+		return err
+	}
+	defer release(unlock, &err)
+
+	var actual string
+	ref, err := s.ReadReference(ctx, refName)
+	switch {
+	case errors.Is(err, ErrRefNotFound):
+	case err != nil:
+		return err
+	case ref.IsSymbolic():
+		return fmt.Errorf("failed to update reference %s: it is a symbolic reference", refName)
+	default:
+		actual = ref.Hash
 	}
 
-	// Upload the reference data
-	if err := s.client.UploadObject(
-		ctx,
-		createObjectTx,
-		[]byte(hash),
-		types.UploadObjectOptions{},
-	); err != nil {
-		return fmt.Errorf("failed to upload reference: %w", err)
+	if actual != expectedOld {
+		return &RefConflictError{Name: refName, Expected: expectedOld, Actual: actual}
+	}
+
+	return s.setReference(ctx, refName, actual, newHash, message)
+}
+
+// lock takes the lock of name, a reference or the packed-refs object, and
+// returns the function releasing it. The lock is taken by atomically
+// creating the lock key, which only one of several concurrent updaters can
+// do; the error matches ErrAlreadyExists if someone else holds it. Like a
+// git lock file, the key holds content, followed by who took the lock and
+// when, which is reported to those who find it taken.
+func (s *ReferenceStorage) lock(ctx context.Context, name, content string) (func() error, error) {
+	lockPath := s.lockPath(name)
+
+	owner := s.identity
+	owner.When = time.Now()
+	data := fmt.Sprintf("%s\n%s%s\n", content, lockOwnerPrefix, owner)
+	if err := s.backend.Create(ctx, lockPath, []byte(data)); err != nil {
+		if errors.Is(err, ErrAlreadyExists) {
+			return nil, fmt.Errorf("failed to lock %s: %s (if it was interrupted, "+
+				"run gitk push --force-unlock or remove %s): %w", name, s.describeLock(ctx, lockPath), lockPath, err)
+		}
+		return nil, fmt.Errorf("failed to lock %s: %w", name, err)
+	}
+
+	return func() error {
+		// A lock left behind blocks every later update, so it is released
+		// even if ctx is done
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), unlockTimeout)
+		defer cancel()
+
+		if err := s.backend.Delete(ctx, lockPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to unlock %s (remove %s): %w", name, lockPath, err)
+		}
+		return nil
+	}, nil
+}
+
+// release calls unlock and adds its failure to *err
+func release(unlock func() error, err *error) {
+	*err = errors.Join(*err, unlock())
+}
+
+func (s *ReferenceStorage) lockPath(name string) string {
+	return path.Join(s.prefix, name) + ".lock"
+}
+
+// describeLock tells who holds the lock at lockPath and since when
+func (s *ReferenceStorage) describeLock(ctx context.Context, lockPath string) string {
+	data, err := s.backend.Get(ctx, lockPath)
+	if err != nil {
+		return "another update is in progress"
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		value, ok := strings.CutPrefix(line, lockOwnerPrefix)
+		if !ok {
+			continue
+		}
+		owner, err := ParseSignature(value)
+		if err != nil {
+			break
+		}
+		return fmt.Sprintf("another update by %s <%s> is in progress since %s",
+			owner.Name, owner.Email, owner.When.Format(time.RFC1123Z))
+	}
+	return "another update is in progress"
+}
+
+// BreakLock removes the lock of the reference refName, left behind by an
+// update that was interrupted, and reports whether there was one. Breaking
+// the lock of an update that is still in progress lets another one
+// overwrite it.
+func (s *ReferenceStorage) BreakLock(ctx context.Context, refName string) (bool, error) {
+	err := s.backend.Delete(ctx, s.lockPath(refName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to unlock %s: %w", refName, err)
+	}
+
+	return true, nil
+}
+
+// SetSymbolicReference makes refName a symbolic reference to target
+func (s *ReferenceStorage) SetSymbolicReference(ctx context.Context, refName, target string) error {
+	return s.writeReference(ctx, refName, symrefPrefix+target+"\n")
+}
+
+func (s *ReferenceStorage) writeReference(ctx context.Context, refName, content string) error {
+	refPath := path.Join(s.prefix, refName)
+
+	if err := s.backend.Put(ctx, refPath, []byte(content)); err != nil {
+		return fmt.Errorf("failed to set reference %s: %w", refName, err)
 	}
 
 	return nil
 }
 
-// GetReference retrieves a Git reference from BNB Greenfield
+// ReadReference retrieves a Git reference from the backend without following
+// symbolic references. Loose references take precedence over the packed-refs
+// object. The error matches ErrRefNotFound if the reference does not exist.
+func (s *ReferenceStorage) ReadReference(ctx context.Context, refName string) (*Reference, error) {
+	return s.readReference(ctx, refName, nil)
+}
+
+// readReference reads refName, falling back to packed, or to the packed-refs
+// object if packed is nil
+func (s *ReferenceStorage) readReference(ctx context.Context, refName string, packed map[string]string) (*Reference, error) {
+	refPath := path.Join(s.prefix, refName)
+
+	data, err := s.backend.Get(ctx, refPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		if packed == nil {
+			var packErr error
+			if packed, packErr = s.readPackedRefs(ctx); packErr != nil {
+				return nil, packErr
+			}
+		}
+		if hash, ok := packed[refName]; ok {
+			return &Reference{Name: refName, Hash: hash}, nil
+		}
+		return nil, fmt.Errorf("reference %s: %w", refName, ErrRefNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get reference %s: %w", refName, err)
+	}
+
+	content := strings.TrimSpace(string(data))
+	if target, ok := strings.CutPrefix(content, symrefPrefix); ok {
+		return &Reference{Name: refName, Target: target}, nil
+	}
+
+	return &Reference{Name: refName, Hash: content}, nil
+}
+
+// ResolveReference follows symbolic references starting at refName and
+// returns the direct reference they lead to. If that reference does not
+// exist, the result is Unborn: it carries the name but no hash.
+func (s *ReferenceStorage) ResolveReference(ctx context.Context, refName string) (*Reference, error) {
+	return s.resolveReference(ctx, refName, nil)
+}
+
+func (s *ReferenceStorage) resolveReference(ctx context.Context, refName string, packed map[string]string) (*Reference, error) {
+	name := refName
+	for depth := 0; depth <= maxSymrefDepth; depth++ {
+		ref, err := s.readReference(ctx, name, packed)
+		if errors.Is(err, ErrRefNotFound) {
+			return &Reference{Name: name}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if !ref.IsSymbolic() {
+			return ref, nil
+		}
+		name = ref.Target
+	}
+
+	return nil, fmt.Errorf("failed to resolve reference %s: too many levels of symbolic references", refName)
+}
+
+// GetReference returns the hash refName resolves to. The error matches
+// ErrRefNotFound if the reference, or the one it points to, does not exist.
 func (s *ReferenceStorage) GetReference(ctx context.Context, refName string) (string, error) {
-	refPath := path.Join(s.prefix, "refs", refName)
-	
-	// Download the reference
-	data, err := s.client.GetObject(
-		ctx,
-		s.bucketName,
-		refPath,
-		types.GetObjectOptions{},
-	)
+	ref, err := s.ResolveReference(ctx, refName)
 	if err != nil {
-		return "", fmt.Errorf("failed to get reference: %w", err)
+		return "", err
+	}
+	if ref.Unborn() {
+		return "", fmt.Errorf("reference %s: %w", ref.Name, ErrRefNotFound)
 	}
 
-	return string(data), nil
+	return ref.Hash, nil
 }
 
-// DeleteReference removes a Git reference from BNB Greenfield
-func (s *ReferenceStorage) DeleteReference(ctx context.Context, refName string) error {
-	refPath := path.Join(s.prefix, "refs", refName)
-	
-	if err := s.client.DeleteObject(
-		ctx,
-		s.bucketName,
-		refPath,
-		types.DeleteObjectOptions{},
-	); err != nil {
-		return fmt.Errorf("failed to delete reference: %w", err)
+// DeleteReference removes a Git reference from the backend, both its loose
+// and its packed form, along with its reflog
+func (s *ReferenceStorage) DeleteReference(ctx context.Context, refName string) (err error) {
+	unlock, err := s.lock(ctx, refName, "")
+	if err != nil {
+		return err
 	}
+	defer release(unlock, &err)
 
-	return nil
+	// Drop the packed value first, so it never shows through once the loose
+	// reference is gone
+	packed, err := s.removePackedRef(ctx, refName)
+	if err != nil {
+		return err
+	}
+
+	refPath := path.Join(s.prefix, refName)
+	if err := s.backend.Delete(ctx, refPath); err != nil && !(packed && errors.Is(err, fs.ErrNotExist)) {
+		return fmt.Errorf("failed to delete reference %s: %w", refName, err)
+	}
+
+	return s.deleteReflog(ctx, refName)
+}
+
+// keyPrefix returns the prefix of all reference keys on the backend
+func (s *ReferenceStorage) keyPrefix() string {
+	if s.prefix == "" {
+		return ""
+	}
+	return strings.TrimSuffix(s.prefix, "/") + "/"
 }
 
-// ListReferences lists all Git references in BNB Greenfield
+// ListReferences lists all Git references below refs/ on the backend and the
+// hashes they resolve to. Symbolic references to unborn branches are skipped.
 func (s *ReferenceStorage) ListReferences(ctx context.Context) (map[string]string, error) {
-	prefix := path.Join(s.prefix, "refs")
-	
-	objects, err := s.client.ListObjects(
-		ctx,
-		s.bucketName,
-		types.ListObjectsOptions{
-			Prefix: prefix,
-		},
-	)
+	refs := make(map[string]string)
+	err := s.ForEachReference(ctx, func(refName, hash string) error {
+		refs[refName] = hash
+		return nil
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to list references: %w", err)
+		return nil, err
 	}
 
-	refs := make(map[string]string)
-	for _, obj := range objects.Objects {
+	return refs, nil
+}
+
+// ForEachReference calls fn with every Git reference below refs/ on the
+// backend and the hash it resolves to, stopping at the first error fn
+// returns. Symbolic references to unborn branches are skipped. Packed
+// references cost a single fetch; only loose ones are read one by one.
+func (s *ReferenceStorage) ForEachReference(ctx context.Context, fn func(refName, hash string) error) error {
+	packed, err := s.readPackedRefs(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Loose references override packed ones
+	loose := make(map[string]bool)
+	err = s.walkLooseReferences(ctx, func(refName string) error {
+		loose[refName] = true
+
+		ref, err := s.resolveReference(ctx, refName, packed)
+		if err != nil {
+			return err
+		}
+		if ref.Unborn() {
+			return nil
+		}
+		return fn(refName, ref.Hash)
+	})
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(packed))
+	for refName := range packed {
+		if !loose[refName] {
+			names = append(names, refName)
+		}
+	}
+	sort.Strings(names)
+
+	for _, refName := range names {
+		if err := fn(refName, packed[refName]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// walkLooseReferences calls fn with the name of every loose reference below refs/
+func (s *ReferenceStorage) walkLooseReferences(ctx context.Context, fn func(refName string) error) error {
+	prefix := path.Join(s.prefix, "refs") + "/"
+
+	return s.backend.Walk(ctx, prefix, func(key string) error {
+		// Skip the locks of references being updated
+		if strings.HasSuffix(key, ".lock") {
+			return nil
+		}
+
 		// Extract reference name from path
-		refName := strings.TrimPrefix(obj.ObjectInfo.ObjectName, prefix+"/")
-		
-		// Get reference value
-		hash, err := s.GetReference(ctx, refName)
+		return fn(strings.TrimPrefix(key, s.keyPrefix()))
+	})
+}
+
+// PackRefs moves the direct references below refs/ into the packed-refs
+// object, so that ListReferences can read them in a single fetch, and returns
+// how many loose references were packed. Symbolic references stay loose, as
+// do references that are updated while packing.
+func (s *ReferenceStorage) PackRefs(ctx context.Context) (_ int, err error) {
+	unlock, err := s.lock(ctx, packedRefsName, "")
+	if err != nil {
+		return 0, err
+	}
+	defer release(unlock, &err)
+
+	packed, err := s.readPackedRefs(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	loose := make(map[string]string)
+	err = s.walkLooseReferences(ctx, func(refName string) error {
+		ref, err := s.readReference(ctx, refName, packed)
+		if errors.Is(err, ErrRefNotFound) {
+			// Deleted since it was listed
+			return nil
+		}
 		if err != nil {
-			return nil, fmt.Errorf("failed to get reference %s: %w", refName, err)
+			return err
+		}
+		if ref.IsSymbolic() {
+			return nil
+		}
+
+		loose[refName] = ref.Hash
+		packed[refName] = ref.Hash
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if err := s.writePackedRefs(ctx, packed); err != nil {
+		return 0, err
+	}
+
+	// The packed values are now in place, so the loose copies can go
+	for refName, hash := range loose {
+		if err := s.pruneLooseRef(ctx, refName, hash); err != nil {
+			return 0, err
 		}
-		
-		refs[refName] = hash
+	}
+
+	return len(loose), nil
+}
+
+// pruneLooseRef deletes the loose reference refName if it still points at
+// hash. A reference that is locked or has moved on is left alone, since its
+// loose value overrides the packed one anyway.
+func (s *ReferenceStorage) pruneLooseRef(ctx context.Context, refName, hash string) (err error) {
+	unlock, err := s.lock(ctx, refName, hash)
+	if errors.Is(err, ErrAlreadyExists) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer release(unlock, &err)
+
+	// Check again under the lock that the loose reference still exists and
+	// holds the packed value. Only the loose value matters here, so packed
+	// values are not consulted.
+	ref, err := s.readReference(ctx, refName, map[string]string{})
+	if errors.Is(err, ErrRefNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if ref.Hash != hash {
+		return nil
+	}
+
+	if err := s.backend.Delete(ctx, path.Join(s.prefix, refName)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to prune reference %s: %w", refName, err)
+	}
+
+	return nil
+}
+
+// removePackedRef drops refName from the packed-refs object and reports
+// whether it was packed. The lock is taken before looking, even if the
+// reference turns out not to be packed: PackRefs may be about to pack it.
+func (s *ReferenceStorage) removePackedRef(ctx context.Context, refName string) (_ bool, err error) {
+	unlock, err := s.lock(ctx, packedRefsName, "")
+	if err != nil {
+		return false, err
+	}
+	defer release(unlock, &err)
+
+	packed, err := s.readPackedRefs(ctx)
+	if err != nil {
+		return false, err
+	}
+	if _, ok := packed[refName]; !ok {
+		return false, nil
+	}
+	delete(packed, refName)
+
+	return true, s.writePackedRefs(ctx, packed)
+}
+
+// readPackedRefs reads the packed-refs object. A missing object holds no references.
+func (s *ReferenceStorage) readPackedRefs(ctx context.Context) (map[string]string, error) {
+	data, err := s.backend.Get(ctx, path.Join(s.prefix, packedRefsName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return make(map[string]string), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get packed references: %w", err)
+	}
+
+	refs, err := parsePackedRefs(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse packed references: %w", err)
 	}
 
 	return refs, nil
 }
+
+func (s *ReferenceStorage) writePackedRefs(ctx context.Context, refs map[string]string) error {
+	if err := s.backend.Put(ctx, path.Join(s.prefix, packedRefsName), encodePackedRefs(refs)); err != nil {
+		return fmt.Errorf("failed to write packed references: %w", err)
+	}
+
+	return nil
+}
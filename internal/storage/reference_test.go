@@ -0,0 +1,87 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/mindkit-xyz/mindkit-gitk/internal/storage"
+	"github.com/mindkit-xyz/mindkit-gitk/internal/storage/greenfieldtest"
+)
+
+var (
+	refIdentity = storage.Signature{Name: "Test", Email: "test@example.com"}
+	hashA       = storage.HashObject(storage.BlobObject, []byte("a\n"))
+	hashB       = storage.HashObject(storage.BlobObject, []byte("b\n"))
+)
+
+func newRefStorage() (storage.Backend, *storage.ReferenceStorage) {
+	_, backend := greenfieldtest.NewBackend()
+	return backend, storage.NewReferenceStorage(backend, "repo", refIdentity)
+}
+
+func TestPackRefsThenDeleteReference(t *testing.T) {
+	ctx := context.Background()
+	_, refs := newRefStorage()
+
+	for name, hash := range map[string]string{"refs/heads/main": hashA, "refs/tags/v1": hashB} {
+		if err := refs.SetReference(ctx, name, hash, "test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, err := refs.PackRefs(ctx); err != nil || n != 2 {
+		t.Fatalf("PackRefs = %d, %v; want 2", n, err)
+	}
+
+	// The packed value goes along with the loose one
+	if err := refs.DeleteReference(ctx, "refs/heads/main"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := refs.GetReference(ctx, "refs/heads/main"); !errors.Is(err, storage.ErrRefNotFound) {
+		t.Errorf("deleted main resolves: %v", err)
+	}
+	if got, err := refs.GetReference(ctx, "refs/tags/v1"); err != nil || got != hashB {
+		t.Errorf("v1 = %q, %v; want %s", got, err, hashB)
+	}
+}
+
+func TestDeleteReferenceNeedsPackedRefsLock(t *testing.T) {
+	ctx := context.Background()
+	backend, refs := newRefStorage()
+
+	if err := refs.SetReference(ctx, "refs/heads/topic", hashA, "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A PackRefs in progress may be packing the loose reference, so it must
+	// not be deleted from under it
+	if err := backend.Create(ctx, "repo/packed-refs.lock", []byte("\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := refs.DeleteReference(ctx, "refs/heads/topic"); !errors.Is(err, storage.ErrAlreadyExists) {
+		t.Fatalf("DeleteReference = %v, want a lock conflict", err)
+	}
+	if got, err := refs.GetReference(ctx, "refs/heads/topic"); err != nil || got != hashA {
+		t.Errorf("topic = %q, %v; want it left at %s", got, err, hashA)
+	}
+}
+
+func TestPackRefsKeepsLockedReferencesLoose(t *testing.T) {
+	ctx := context.Background()
+	backend, refs := newRefStorage()
+
+	if err := refs.SetReference(ctx, "refs/heads/main", hashA, "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	// An update of main is in progress: its loose value stays
+	if err := backend.Create(ctx, "repo/refs/heads/main.lock", []byte(hashB+"\n")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := refs.PackRefs(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := backend.Head(ctx, "repo/refs/heads/main"); err != nil {
+		t.Errorf("loose main was pruned while locked: %v", err)
+	}
+}
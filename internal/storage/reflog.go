@@ -0,0 +1,196 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// zeroHash stands for a missing reference in reflog entries
+const zeroHash = "0000000000000000000000000000000000000000"
+
+// ReflogEntry records one update of a reference: the hashes it moved from
+// and to, who moved it and why. Old is empty for a newly created reference.
+type ReflogEntry struct {
+	Old       string
+	New       string
+	Committer Signature
+	Message   string
+}
+
+// String formats the entry as a line of a reflog file
+func (e *ReflogEntry) String() string {
+	orZero := func(hash string) string {
+		if hash == "" {
+			return zeroHash
+		}
+		return hash
+	}
+	return fmt.Sprintf("%s %s %s\t%s\n", orZero(e.Old), orZero(e.New), e.Committer, e.Message)
+}
+
+// ParseReflogEntry parses a line of a reflog file
+func ParseReflogEntry(line string) (*ReflogEntry, error) {
+	header, message, _ := strings.Cut(strings.TrimSuffix(line, "\n"), "\t")
+
+	oldHash, rest, ok1 := strings.Cut(header, " ")
+	newHash, who, ok2 := strings.Cut(rest, " ")
+	if !ok1 || !ok2 || len(oldHash) != 40 || len(newHash) != 40 {
+		return nil, fmt.Errorf("invalid reflog entry %q", line)
+	}
+
+	committer, err := ParseSignature(who)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &ReflogEntry{Old: oldHash, New: newHash, Committer: committer, Message: message}
+	if entry.Old == zeroHash {
+		entry.Old = ""
+	}
+	if entry.New == zeroHash {
+		entry.New = ""
+	}
+
+	return entry, nil
+}
+
+// reflogSeqDigits is the width of the zero-padded sequence numbers that
+// name reflog entries, so that their keys sort in the order of the entries
+const reflogSeqDigits = 10
+
+// ReadReflog returns the reflog of refName, oldest entry first. A reference
+// without a reflog has no entries. Each entry is a key of its own, so this
+// fetches as many keys as the reflog has entries.
+func (s *ReferenceStorage) ReadReflog(ctx context.Context, refName string) ([]*ReflogEntry, error) {
+	keys, err := s.reflogKeys(ctx, refName)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]*ReflogEntry, 0, len(keys))
+	for _, key := range keys {
+		data, err := s.backend.Get(ctx, key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get reflog of %s: %w", refName, err)
+		}
+		entry, err := ParseReflogEntry(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse reflog of %s: %w", refName, err)
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// logUpdate appends an entry for the move of refName from oldHash to newHash
+// to its reflog, and to the reflog of HEAD if HEAD points at refName, as git does
+func (s *ReferenceStorage) logUpdate(ctx context.Context, refName, oldHash, newHash, message string) error {
+	committer := s.identity
+	committer.When = time.Now()
+	entry := &ReflogEntry{
+		Old:       oldHash,
+		New:       newHash,
+		Committer: committer,
+		Message:   strings.ReplaceAll(strings.TrimSpace(message), "\n", " "),
+	}
+
+	names := []string{refName}
+	if refName != "HEAD" {
+		head, err := s.ReadReference(ctx, "HEAD")
+		if err != nil && !errors.Is(err, ErrRefNotFound) {
+			return err
+		}
+		if err == nil && head.Target == refName {
+			names = append(names, "HEAD")
+		}
+	}
+
+	for _, name := range names {
+		if err := s.appendReflog(ctx, name, entry); err != nil {
+			return fmt.Errorf("failed to write reflog of %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// appendReflog stores entry under the sequence number after the last entry
+// of the reflog of refName. Entries are only ever created, never rewritten,
+// so appends need no lock: one racing for the same number fails to create
+// it and takes the next.
+func (s *ReferenceStorage) appendReflog(ctx context.Context, refName string, entry *ReflogEntry) error {
+	keys, err := s.reflogKeys(ctx, refName)
+	if err != nil {
+		return err
+	}
+
+	var seq int
+	if len(keys) > 0 {
+		last := keys[len(keys)-1]
+		if seq, err = strconv.Atoi(path.Base(last)); err != nil {
+			return fmt.Errorf("invalid reflog entry %s: %w", last, err)
+		}
+	}
+
+	for {
+		seq++
+		err := s.backend.Create(ctx, s.reflogEntryPath(refName, seq), []byte(entry.String()))
+		if !errors.Is(err, ErrAlreadyExists) {
+			return err
+		}
+	}
+}
+
+// reflogKeys returns the keys of the entries in the reflog of refName,
+// oldest first
+func (s *ReferenceStorage) reflogKeys(ctx context.Context, refName string) ([]string, error) {
+	prefix := s.reflogPath(refName) + "/"
+
+	var keys []string
+	err := s.backend.Walk(ctx, prefix, func(key string) error {
+		// Skip the reflogs of references below refName
+		if seq := strings.TrimPrefix(key, prefix); len(seq) == reflogSeqDigits && !strings.Contains(seq, "/") {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list reflog of %s: %w", refName, err)
+	}
+	sort.Strings(keys)
+
+	return keys, nil
+}
+
+// deleteReflog removes every entry of the reflog of refName
+func (s *ReferenceStorage) deleteReflog(ctx context.Context, refName string) error {
+	keys, err := s.reflogKeys(ctx, refName)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if err := s.backend.Delete(ctx, key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to delete reflog of %s: %w", refName, err)
+		}
+	}
+
+	return nil
+}
+
+// reflogPath returns the prefix of the keys of the entries in the reflog of refName
+func (s *ReferenceStorage) reflogPath(refName string) string {
+	return path.Join(s.prefix, "logs", refName)
+}
+
+func (s *ReferenceStorage) reflogEntryPath(refName string, seq int) string {
+	return path.Join(s.reflogPath(refName), fmt.Sprintf("%0*d", reflogSeqDigits, seq))
+}
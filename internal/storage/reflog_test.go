@@ -0,0 +1,148 @@
+package storage_test
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mindkit-xyz/mindkit-gitk/internal/storage"
+	"github.com/mindkit-xyz/mindkit-gitk/internal/storage/greenfieldtest"
+)
+
+// reflogSummary returns the old and new hash and the message of each entry
+func reflogSummary(t *testing.T, refs *storage.ReferenceStorage, refName string) [][3]string {
+	t.Helper()
+
+	entries, err := refs.ReadReflog(context.Background(), refName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	summary := make([][3]string, len(entries))
+	for i, entry := range entries {
+		if entry.Committer.Email != refIdentity.Email {
+			t.Errorf("entry %d of %s was committed by %s", i, refName, entry.Committer)
+		}
+		summary[i] = [3]string{entry.Old, entry.New, entry.Message}
+	}
+	return summary
+}
+
+func TestReflogRecordsUpdatesOfBranchAndHead(t *testing.T) {
+	_, greenfield := greenfieldtest.NewBackend()
+	for name, backend := range map[string]storage.Backend{
+		"greenfield": greenfield,
+		"local":      storage.NewLocalBackend(t.TempDir()),
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			refs := storage.NewReferenceStorage(backend, "repo", refIdentity)
+
+			if err := refs.SetSymbolicReference(ctx, "HEAD", "refs/heads/main"); err != nil {
+				t.Fatal(err)
+			}
+			if err := refs.SetReference(ctx, "refs/heads/main", hashA, "commit (initial): a"); err != nil {
+				t.Fatal(err)
+			}
+			if err := refs.CompareAndSetReference(ctx, "refs/heads/main", hashB, hashA, "commit: b\nmore"); err != nil {
+				t.Fatal(err)
+			}
+			// Branches HEAD does not point at only get a reflog of their own
+			if err := refs.SetReference(ctx, "refs/heads/topic", hashA, "branch: Created from main"); err != nil {
+				t.Fatal(err)
+			}
+
+			want := [][3]string{
+				{"", hashA, "commit (initial): a"},
+				{hashA, hashB, "commit: b more"},
+			}
+			for _, refName := range []string{"refs/heads/main", "HEAD"} {
+				if got := reflogSummary(t, refs, refName); !reflect.DeepEqual(got, want) {
+					t.Errorf("reflog of %s = %q, want %q", refName, got, want)
+				}
+			}
+			if got, want := reflogSummary(t, refs, "refs/heads/topic"), [][3]string{{"", hashA, "branch: Created from main"}}; !reflect.DeepEqual(got, want) {
+				t.Errorf("reflog of refs/heads/topic = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestReflogKeepsNestedReferencesApart(t *testing.T) {
+	ctx := context.Background()
+	_, refs := newRefStorage()
+
+	// Flat keys let a reference and one below it coexist on Greenfield
+	if err := refs.SetReference(ctx, "refs/heads/a", hashA, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := refs.SetReference(ctx, "refs/heads/a/b", hashB, "a/b"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := reflogSummary(t, refs, "refs/heads/a"), [][3]string{{"", hashA, "a"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("reflog of refs/heads/a = %q, want %q", got, want)
+	}
+
+	// Deleting a reference drops its reflog only
+	if err := refs.DeleteReference(ctx, "refs/heads/a"); err != nil {
+		t.Fatal(err)
+	}
+	if got := reflogSummary(t, refs, "refs/heads/a"); len(got) != 0 {
+		t.Errorf("reflog of deleted refs/heads/a = %q", got)
+	}
+	if got, want := reflogSummary(t, refs, "refs/heads/a/b"), [][3]string{{"", hashB, "a/b"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("reflog of refs/heads/a/b = %q, want %q", got, want)
+	}
+}
+
+// racingBackend runs before ahead of the next Create of a key containing
+// "/logs/", as if another process got there first
+type racingBackend struct {
+	storage.Backend
+	before func(key string)
+}
+
+func (b *racingBackend) Create(ctx context.Context, key string, data []byte) error {
+	if b.before != nil && strings.Contains(key, "/logs/") {
+		before := b.before
+		b.before = nil
+		before(key)
+	}
+	return b.Backend.Create(ctx, key, data)
+}
+
+func TestReflogAppendSkipsEntryTakenConcurrently(t *testing.T) {
+	ctx := context.Background()
+	_, backend := greenfieldtest.NewBackend()
+	racing := &racingBackend{Backend: backend}
+	refs := storage.NewReferenceStorage(racing, "repo", refIdentity)
+	if err := refs.SetReference(ctx, "refs/heads/main", hashA, "first"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another process appends between listing the reflog and writing to it
+	racing.before = func(key string) {
+		entry := &storage.ReflogEntry{Old: hashA, New: hashA, Committer: refIdentity, Message: "other"}
+		if err := backend.Create(ctx, key, []byte(entry.String())); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := refs.SetReference(ctx, "refs/heads/main", hashB, "second"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := [][3]string{{"", hashA, "first"}, {hashA, hashA, "other"}, {hashA, hashB, "second"}}
+	if got := reflogSummary(t, refs, "refs/heads/main"); !reflect.DeepEqual(got, want) {
+		t.Errorf("reflog = %q, want %q", got, want)
+	}
+}
+
+func TestReadReflogOfReferenceWithoutReflog(t *testing.T) {
+	_, refs := newRefStorage()
+
+	entries, err := refs.ReadReflog(context.Background(), "refs/heads/missing")
+	if err != nil || len(entries) != 0 {
+		t.Fatalf("ReadReflog = %v, %v; want no entries", entries, err)
+	}
+}
@@ -0,0 +1,221 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy configures how RetryBackend retries operations that fail
+// with ErrTransient
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first
+	MaxAttempts int
+	// InitialDelay is the upper bound of the wait before the first retry
+	InitialDelay time.Duration
+	// MaxDelay caps the wait between two attempts
+	MaxDelay time.Duration
+	// Multiplier grows the delay bound from one retry to the next. Below 1,
+	// the bound stays at InitialDelay.
+	Multiplier float64
+}
+
+// DefaultRetryPolicy rides out short storage provider hiccups without
+// making a failing command hang for long
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:  5,
+	InitialDelay: 200 * time.Millisecond,
+	MaxDelay:     5 * time.Second,
+	Multiplier:   2,
+}
+
+// delay returns the wait before retry number n, counting from 0. It is
+// drawn uniformly up to an exponentially growing bound ("full jitter"),
+// so that clients failing together do not retry together.
+func (p RetryPolicy) delay(n int) time.Duration {
+	bound := float64(p.InitialDelay)
+	for i := 0; i < n && bound < float64(p.MaxDelay) && p.Multiplier > 1; i++ {
+		bound *= p.Multiplier
+	}
+	if bound > float64(p.MaxDelay) {
+		bound = float64(p.MaxDelay)
+	}
+	if bound < 1 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(bound)))
+}
+
+// RetryBackend wraps a Backend and retries its operations when they fail
+// with ErrTransient. Other errors are returned right away.
+//
+// Create is not retried. A transient failure does not tell whether the
+// attempt took effect, so a retried Create could report a key it took
+// itself as taken.
+type RetryBackend struct {
+	backend Backend
+	policy  RetryPolicy
+}
+
+// NewRetryBackend creates a backend that retries the operations of backend
+// according to policy
+func NewRetryBackend(backend Backend, policy RetryPolicy) *RetryBackend {
+	return &RetryBackend{
+		backend: backend,
+		policy:  policy,
+	}
+}
+
+// retry calls op until it succeeds, fails with an error that is not
+// transient, or runs out of attempts. It does not start a wait that would
+// outlast the deadline of ctx, and returns the last error instead.
+func (b *RetryBackend) retry(ctx context.Context, op func() error) error {
+	for n := 0; ; n++ {
+		err := op()
+		if err == nil || !errors.Is(err, ErrTransient) || n+1 >= b.policy.MaxAttempts {
+			return err
+		}
+
+		delay := b.policy.delay(n)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			return err
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// Put stores data under key
+func (b *RetryBackend) Put(ctx context.Context, key string, data []byte) error {
+	return b.retry(ctx, func() error {
+		return b.backend.Put(ctx, key, data)
+	})
+}
+
+// PutFrom stores the data read from r under key. It is only retried if r
+// is an io.Seeker, which is rewound before each attempt.
+func (b *RetryBackend) PutFrom(ctx context.Context, key string, r io.Reader) error {
+	seeker, ok := r.(io.Seeker)
+	if !ok {
+		return b.backend.PutFrom(ctx, key, r)
+	}
+
+	start, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return b.backend.PutFrom(ctx, key, r)
+	}
+	return b.retry(ctx, func() error {
+		if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+			return err
+		}
+		return b.backend.PutFrom(ctx, key, r)
+	})
+}
+
+// Create stores data under key if the key does not exist yet. It is not
+// retried.
+func (b *RetryBackend) Create(ctx context.Context, key string, data []byte) error {
+	return b.backend.Create(ctx, key, data)
+}
+
+// CreateBatch stores each entry like Create. A retry after a partial success
+// fails with ErrAlreadyExists, which callers handle by storing the entries
+// one by one.
+func (b *RetryBackend) CreateBatch(ctx context.Context, entries []KeyData) error {
+	return b.retry(ctx, func() error {
+		return b.backend.CreateBatch(ctx, entries)
+	})
+}
+
+// Get retrieves the data stored under key
+func (b *RetryBackend) Get(ctx context.Context, key string) ([]byte, error) {
+	var data []byte
+	err := b.retry(ctx, func() error {
+		var err error
+		data, err = b.backend.Get(ctx, key)
+		return err
+	})
+	return data, err
+}
+
+// Open returns a reader of the data stored under key. Only opening is
+// retried, not failures while reading.
+func (b *RetryBackend) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	var rc io.ReadCloser
+	err := b.retry(ctx, func() error {
+		var err error
+		rc, err = b.backend.Open(ctx, key)
+		return err
+	})
+	return rc, err
+}
+
+// GetRange retrieves part of the data stored under key
+func (b *RetryBackend) GetRange(ctx context.Context, key string, offset, length int64) ([]byte, error) {
+	var data []byte
+	err := b.retry(ctx, func() error {
+		var err error
+		data, err = b.backend.GetRange(ctx, key, offset, length)
+		return err
+	})
+	return data, err
+}
+
+// Head returns metadata about the data stored under key
+func (b *RetryBackend) Head(ctx context.Context, key string) (*KeyInfo, error) {
+	var info *KeyInfo
+	err := b.retry(ctx, func() error {
+		var err error
+		info, err = b.backend.Head(ctx, key)
+		return err
+	})
+	return info, err
+}
+
+// Delete removes the data stored under key
+func (b *RetryBackend) Delete(ctx context.Context, key string) error {
+	return b.retry(ctx, func() error {
+		return b.backend.Delete(ctx, key)
+	})
+}
+
+// Walk retries a failed listing from the start, skipping the keys already
+// passed to fn. It cannot resume after the last key instead, as keys are not
+// reported in lexical order: Greenfield reports a journaled key where its
+// journal sorts. Errors returned by fn are never retried.
+func (b *RetryBackend) Walk(ctx context.Context, prefix string, fn func(key string) error) error {
+	delivered := make(map[string]bool)
+	var fnErr error
+
+	err := b.retry(ctx, func() error {
+		err := b.backend.Walk(ctx, prefix, func(key string) error {
+			if delivered[key] {
+				return nil
+			}
+			if fnErr = fn(key); fnErr != nil {
+				return fnErr
+			}
+			delivered[key] = true
+			return nil
+		})
+		if fnErr != nil {
+			// Reported below, whatever its kind
+			return nil
+		}
+		return err
+	})
+	if fnErr != nil {
+		return fnErr
+	}
+
+	return err
+}
@@ -0,0 +1,34 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryDelayBounds(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy RetryPolicy
+		bounds []time.Duration
+	}{
+		{"exponential", DefaultRetryPolicy, []time.Duration{
+			200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond,
+			1600 * time.Millisecond, 3200 * time.Millisecond, 5 * time.Second, 5 * time.Second,
+		}},
+		{"no multiplier", RetryPolicy{InitialDelay: time.Second, MaxDelay: time.Minute}, []time.Duration{
+			time.Second, time.Second, time.Second,
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for n, bound := range tt.bounds {
+				for i := 0; i < 100; i++ {
+					if d := tt.policy.delay(n); d <= 0 || d > bound {
+						t.Fatalf("delay(%d) = %v, want within (0, %v]", n, d, bound)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,227 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bnb-chain/greenfield-go-sdk/types"
+	"github.com/mindkit-xyz/mindkit-gitk/internal/storage"
+	"github.com/mindkit-xyz/mindkit-gitk/internal/storage/greenfieldtest"
+)
+
+// fastRetries retries without waiting noticeably
+var fastRetries = storage.RetryPolicy{
+	MaxAttempts:  4,
+	InitialDelay: time.Millisecond,
+	MaxDelay:     time.Millisecond,
+	Multiplier:   2,
+}
+
+func newRetryBackend(policy storage.RetryPolicy) (*greenfieldtest.Client, *storage.RetryBackend) {
+	client, backend := greenfieldtest.NewBackend()
+	return client, storage.NewRetryBackend(backend, policy)
+}
+
+func TestRetryRecoversFromServiceUnavailable(t *testing.T) {
+	ctx := context.Background()
+	client, backend := newRetryBackend(fastRetries)
+	if err := backend.Put(ctx, "key", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+
+	unavailable := greenfieldtest.ErrServiceUnavailable
+	client.FailNext("GetObject", unavailable, unavailable, unavailable)
+	data, err := backend.Get(ctx, "key")
+	if err != nil || string(data) != "data" {
+		t.Fatalf("Get = %q, %v; want the data after three retries", data, err)
+	}
+	if got := client.Calls("GetObject"); got != 4 {
+		t.Errorf("GetObject called %d times, want 4", got)
+	}
+}
+
+func TestRetryGivesUpAfterMaxAttempts(t *testing.T) {
+	ctx := context.Background()
+	client, backend := newRetryBackend(fastRetries)
+	if err := backend.Put(ctx, "key", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+
+	unavailable := greenfieldtest.ErrServiceUnavailable
+	client.FailNext("GetObject", unavailable, unavailable, unavailable, unavailable, unavailable)
+	if _, err := backend.Get(ctx, "key"); !errors.Is(err, storage.ErrTransient) {
+		t.Fatalf("Get = %v, want ErrTransient", err)
+	}
+	if got := client.Calls("GetObject"); got != fastRetries.MaxAttempts {
+		t.Errorf("GetObject called %d times, want %d", got, fastRetries.MaxAttempts)
+	}
+}
+
+func TestRetrySkipsPermanentErrors(t *testing.T) {
+	ctx := context.Background()
+	client, backend := newRetryBackend(fastRetries)
+	if err := backend.Create(ctx, "key", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A taken name stays taken
+	if err := backend.Create(ctx, "key", []byte("other")); !errors.Is(err, storage.ErrAlreadyExists) {
+		t.Fatalf("Create = %v, want ErrAlreadyExists", err)
+	}
+	if got := client.Calls("CreateObject"); got != 2 {
+		t.Errorf("CreateObject called %d times, want 2", got)
+	}
+
+	// So does a missing permission
+	client.FailNext("GetObject", types.ErrResponse{
+		StatusCode: http.StatusForbidden,
+		Code:       "AccessDenied",
+		Message:    "Access Denied",
+	})
+	if _, err := backend.Get(ctx, "key"); !errors.Is(err, storage.ErrPermissionDenied) {
+		t.Fatalf("Get = %v, want ErrPermissionDenied", err)
+	}
+	if got := client.Calls("GetObject"); got != 1 {
+		t.Errorf("GetObject called %d times, want 1", got)
+	}
+}
+
+func TestRetrySkipsCreate(t *testing.T) {
+	ctx := context.Background()
+	client, backend := newRetryBackend(fastRetries)
+
+	// The object may have been created before the failure was reported
+	client.FailNext("CreateObject", greenfieldtest.ErrServiceUnavailable)
+	if err := backend.Create(ctx, "key", []byte("data")); !errors.Is(err, storage.ErrTransient) {
+		t.Fatalf("Create = %v, want ErrTransient", err)
+	}
+	if got := client.Calls("CreateObject"); got != 1 {
+		t.Errorf("CreateObject called %d times, want 1", got)
+	}
+}
+
+func TestRetryStopsWhenContextIsCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	policy := storage.RetryPolicy{
+		MaxAttempts:  3,
+		InitialDelay: time.Hour,
+		MaxDelay:     time.Hour,
+		Multiplier:   2,
+	}
+	client, backend := newRetryBackend(policy)
+	unavailable := greenfieldtest.ErrServiceUnavailable
+	client.FailNext("GetObject", unavailable, unavailable, unavailable)
+
+	time.AfterFunc(10*time.Millisecond, cancel)
+	start := time.Now()
+	if _, err := backend.Get(ctx, "key"); !errors.Is(err, storage.ErrTransient) {
+		t.Fatalf("Get = %v, want the transient error it was waiting to retry", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Minute {
+		t.Errorf("Get returned after %v, want right after the cancellation", elapsed)
+	}
+	if got := client.Calls("GetObject"); got != 1 {
+		t.Errorf("GetObject called %d times, want 1", got)
+	}
+}
+
+func TestRetryDoesNotWaitPastDeadline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	policy := storage.RetryPolicy{
+		MaxAttempts:  3,
+		InitialDelay: time.Hour,
+		MaxDelay:     time.Hour,
+		Multiplier:   2,
+	}
+	client, backend := newRetryBackend(policy)
+	client.FailNext("GetObject", greenfieldtest.ErrServiceUnavailable)
+
+	// Almost any delay drawn is past the deadline, so Get fails right away
+	start := time.Now()
+	if _, err := backend.Get(ctx, "key"); !errors.Is(err, storage.ErrTransient) {
+		t.Fatalf("Get = %v, want ErrTransient", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Get returned after %v, past the deadline", elapsed)
+	}
+}
+
+func TestRetryWalkDoesNotRepeatKeys(t *testing.T) {
+	ctx := context.Background()
+	client, backend := newRetryBackend(fastRetries)
+	for _, key := range []string{"p/a", "p/b", "p/c.pending", "p/d"} {
+		if err := backend.Create(ctx, key, []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The journal of p/c is looked up after p/a and p/b have been delivered
+	client.FailNext("HeadObject", greenfieldtest.ErrServiceUnavailable)
+	var keys []string
+	if err := backend.Walk(ctx, "p/", func(key string) error {
+		keys = append(keys, key)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"p/a", "p/b", "p/c", "p/d"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("Walk delivered %q, want %q", keys, want)
+	}
+	if got := client.Calls("ListObjects"); got != 2 {
+		t.Errorf("ListObjects called %d times, want 2", got)
+	}
+}
+
+func TestRetryWalkDoesNotRepeatKeysAfterJournaledKey(t *testing.T) {
+	ctx := context.Background()
+	client, backend := newRetryBackend(fastRetries)
+	for _, key := range []string{"p/a-b", "p/a.pending", "p/c.pending"} {
+		if err := backend.Create(ctx, key, []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// p/a is reported where its journal sorts, after p/a-b, and the listing
+	// fails on the journal of p/c
+	client.FailNext("HeadObject", nil, greenfieldtest.ErrServiceUnavailable)
+	var keys []string
+	if err := backend.Walk(ctx, "p/", func(key string) error {
+		keys = append(keys, key)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"p/a-b", "p/a", "p/c"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("Walk delivered %q, want %q", keys, want)
+	}
+}
+
+func TestRetryWalkReturnsCallbackError(t *testing.T) {
+	ctx := context.Background()
+	client, backend := newRetryBackend(fastRetries)
+	if err := backend.Create(ctx, "p/a", []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A transient error from fn is the caller's, not the storage's
+	fnErr := errors.Join(errors.New("callback failed"), storage.ErrTransient)
+	err := backend.Walk(ctx, "p/", func(key string) error {
+		return fnErr
+	})
+	if err != fnErr {
+		t.Fatalf("Walk = %v, want the callback error", err)
+	}
+	if got := client.Calls("ListObjects"); got != 1 {
+		t.Errorf("ListObjects called %d times, want 1", got)
+	}
+}
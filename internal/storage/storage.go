@@ -3,32 +3,28 @@ package storage
 import (
 	"context"
 	"io"
-
-	gsdk "github.com/bnb-chain/greenfield-go-sdk/client"
 )
 
 // Storage implements the Git storage interface using BNB Greenfield
 type Storage struct {
-	client     *gsdk.GreenfieldClient
-	bucketName string
+	backend Backend
 }
 
 // NewStorage creates a new BNB Greenfield storage instance
-func NewStorage(client *gsdk.GreenfieldClient, bucketName string) *Storage {
+func NewStorage(client GreenfieldClient, bucketName string) *Storage {
 	return &Storage{
-		client:     client,
-		bucketName: bucketName,
+		backend: NewGreenfieldBackend(client, bucketName),
 	}
 }
 
-// Store stores an object in BNB Greenfield
+// Store stores the data read from reader in BNB Greenfield under key,
+// replacing any object stored there
 func (s *Storage) Store(ctx context.Context, key string, reader io.Reader) error {
-	// Implementation for storing objects in Greenfield
-	return nil
+	return s.backend.PutFrom(ctx, key, reader)
 }
 
-// Get retrieves an object from BNB Greenfield
+// Get retrieves an object from BNB Greenfield. The caller must close the
+// returned reader.
 func (s *Storage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
-	// Implementation for retrieving objects from Greenfield
-	return nil, nil
+	return s.backend.Open(ctx, key)
 }
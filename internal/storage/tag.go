@@ -0,0 +1,67 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Tag is an annotated Git tag object
+type Tag struct {
+	Object       string
+	ObjectType   string
+	Name         string
+	Tagger       *Signature // nil for old tags created without a tagger
+	ExtraHeaders []ExtraHeader
+	Message      string
+}
+
+// Type returns the Git object type of the tag
+func (t *Tag) Type() string {
+	return TagObject
+}
+
+// Serialize encodes the tag in Git's tag object format
+func (t *Tag) Serialize() ([]byte, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "object %s\n", t.Object)
+	fmt.Fprintf(&buf, "type %s\n", t.ObjectType)
+	fmt.Fprintf(&buf, "tag %s\n", t.Name)
+	if t.Tagger != nil {
+		fmt.Fprintf(&buf, "tagger %s\n", t.Tagger)
+	}
+	writeExtraHeaders(&buf, t.ExtraHeaders)
+	buf.WriteByte('\n')
+	buf.WriteString(t.Message)
+	return buf.Bytes(), nil
+}
+
+// ParseTag parses the contents of a tag object
+func ParseTag(data []byte) (*Tag, error) {
+	headers, message := parseHeaders(data)
+
+	tag := &Tag{Message: message}
+	for _, header := range headers {
+		switch header.Key {
+		case "object":
+			tag.Object = header.Value
+		case "type":
+			tag.ObjectType = header.Value
+		case "tag":
+			tag.Name = header.Value
+		case "tagger":
+			tagger, err := ParseSignature(header.Value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid tagger header: %w", err)
+			}
+			tag.Tagger = &tagger
+		default:
+			tag.ExtraHeaders = append(tag.ExtraHeaders, header)
+		}
+	}
+
+	if tag.Object == "" || tag.ObjectType == "" {
+		return nil, fmt.Errorf("tag has no object")
+	}
+
+	return tag, nil
+}
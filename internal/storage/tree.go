@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// FileMode is the mode of a Git tree entry
+type FileMode uint32
+
+// Modes Git records in tree entries
+const (
+	ModeTree       FileMode = 0040000
+	ModeBlob       FileMode = 0100644
+	ModeExecutable FileMode = 0100755
+	ModeSymlink    FileMode = 0120000
+	ModeSubmodule  FileMode = 0160000
+)
+
+// String returns the mode in the octal notation used in trees
+func (m FileMode) String() string {
+	return strconv.FormatUint(uint64(m), 8)
+}
+
+// IsTree reports whether the entry refers to a subtree
+func (m FileMode) IsTree() bool {
+	return m&0170000 == ModeTree
+}
+
+// TreeEntry is a single entry of a Git tree object
+type TreeEntry struct {
+	Mode FileMode
+	Name string
+	Hash string
+}
+
+// Tree is a Git tree object listing the contents of a directory
+type Tree struct {
+	Entries []TreeEntry
+}
+
+// Type returns the Git object type of the tree
+func (t *Tree) Type() string {
+	return TreeObject
+}
+
+// Serialize encodes the tree in Git's binary format, with the entries
+// in Git's canonical order. It fails if an entry hash is not a SHA-1 in hex.
+func (t *Tree) Serialize() ([]byte, error) {
+	entries := make([]TreeEntry, len(t.Entries))
+	copy(entries, t.Entries)
+	sortTreeEntries(entries)
+
+	var buf bytes.Buffer
+	for _, entry := range entries {
+		hash, err := hex.DecodeString(entry.Hash)
+		if err != nil || len(hash) != 20 {
+			return nil, fmt.Errorf("invalid hash %q of tree entry %q", entry.Hash, entry.Name)
+		}
+		fmt.Fprintf(&buf, "%s %s\x00", entry.Mode, entry.Name)
+		buf.Write(hash)
+	}
+	return buf.Bytes(), nil
+}
+
+// ParseTree parses the contents of a tree object
+func ParseTree(data []byte) (*Tree, error) {
+	tree := &Tree{}
+	for len(data) > 0 {
+		sp := bytes.IndexByte(data, ' ')
+		if sp < 0 {
+			return nil, fmt.Errorf("invalid tree entry: missing mode")
+		}
+		mode, err := strconv.ParseUint(string(data[:sp]), 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tree entry mode %q", data[:sp])
+		}
+		data = data[sp+1:]
+
+		nul := bytes.IndexByte(data, 0)
+		if nul < 0 {
+			return nil, fmt.Errorf("invalid tree entry: missing name")
+		}
+		name := string(data[:nul])
+		data = data[nul+1:]
+
+		if len(data) < 20 {
+			return nil, fmt.Errorf("invalid tree entry %q: truncated hash", name)
+		}
+		tree.Entries = append(tree.Entries, TreeEntry{
+			Mode: FileMode(mode),
+			Name: name,
+			Hash: hex.EncodeToString(data[:20]),
+		})
+		data = data[20:]
+	}
+	return tree, nil
+}
+
+// sortTreeEntries sorts entries the way Git orders them in a tree, comparing
+// the names of subtrees as if they ended with a slash
+func sortTreeEntries(entries []TreeEntry) {
+	sortKey := func(entry TreeEntry) string {
+		if entry.Mode.IsTree() {
+			return entry.Name + "/"
+		}
+		return entry.Name
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return sortKey(entries[i]) < sortKey(entries[j])
+	})
+}